@@ -0,0 +1,367 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"shared-expenses-app/models"
+	"shared-expenses-app/utils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// DeletedUserName replaces the name of deleted accounts.
+const DeletedUserName = "Deleted user"
+
+// UserBalances returns the user's net position in every group where it isn't settled.
+func UserBalances(ctx context.Context, pool *pgxpool.Pool, userID string) ([]models.GroupBalance, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT g.group_id, g.group_name,
+			COALESCE(SUM(
+				es.amount
+				* CASE WHEN es.is_paid THEN 1 ELSE -1 END
+				* CASE WHEN e.kind IN ($3, $4) THEN -1 ELSE 1 END
+			), 0)
+		FROM expense_splits es
+		JOIN expenses e ON e.expense_id = es.expense_id
+		JOIN groups g ON g.group_id = e.group_id
+		WHERE es.user_id = $1 AND e.status = $2
+		GROUP BY g.group_id, g.group_name
+		ORDER BY g.group_name
+	`, userID, models.ExpenseStatusApproved, models.ExpenseKindIncome, models.ExpenseKindRefund)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []models.GroupBalance{}
+	for rows.Next() {
+		var b models.GroupBalance
+		if err := rows.Scan(&b.GroupID, &b.GroupName, &b.Net); err != nil {
+			return nil, err
+		}
+		b.Net = utils.RoundCents(b.Net)
+		if b.Net != 0 {
+			balances = append(balances, b)
+		}
+	}
+	return balances, rows.Err()
+}
+
+// SharedGroupsOwnedBy returns the groups the user owns that have other members.
+func SharedGroupsOwnedBy(ctx context.Context, pool *pgxpool.Pool, userID string) ([]models.Group, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT g.group_id, g.group_name, g.description, g.created_by, extract(epoch from g.created_at)::bigint,
+			g.require_confirmation
+		FROM groups g
+		JOIN group_members owner ON owner.group_id = g.group_id
+		WHERE owner.user_id = $1 AND owner.role = $2
+		AND EXISTS (
+			SELECT 1 FROM group_members gm WHERE gm.group_id = g.group_id AND gm.user_id <> $1 AND gm.left_at IS NULL
+		)
+		ORDER BY g.created_at DESC
+	`, userID, models.RoleOwner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []models.Group{}
+	for rows.Next() {
+		var g models.Group
+		err := rows.Scan(&g.GroupID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedAt, &g.RequireConfirmation)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+// MergeAccounts merges the duplicate account fromID into intoID in one transaction,
+// see mergeUsers. Neither may be deleted, and guests can only be merged away.
+func MergeAccounts(ctx context.Context, pool *pgxpool.Pool, fromID, intoID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var found int
+	err = tx.QueryRow(
+		ctx,
+		`SELECT count(*) FROM users
+		 WHERE deleted_at IS NULL
+		 AND (user_id = $1 OR (user_id = $2 AND NOT is_guest))`,
+		fromID, intoID,
+	).Scan(&found)
+	if err != nil {
+		return err
+	}
+	if found != 2 || fromID == intoID {
+		return ErrUserNotFound
+	}
+
+	if err := mergeUsers(ctx, tx, fromID, intoID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// mergeUsers moves everything fromID took part in over to intoID, deletes fromID
+// and leaves a redirect to intoID. Where both have a share of the same expense or
+// template the shares are added up, so every expense still balances. Group
+// weights and confirmations of intoID win over those of fromID. Sign-in
+// identities move along, while sessions, tokens and the password of fromID go.
+func mergeUsers(ctx context.Context, tx pgx.Tx, fromID, intoID string) error {
+	if fromID == intoID {
+		return errors.New("cannot merge a user into itself")
+	}
+
+	batch := &pgx.Batch{}
+
+	// Shares both users have are added up, the rest change hands
+	for _, table := range []struct{ name, key string }{
+		{"expense_splits", "expense_id = f.expense_id AND i.is_paid = f.is_paid"},
+		{"expense_template_splits", "template_id = f.template_id AND i.is_paid = f.is_paid"},
+	} {
+		batch.Queue(
+			`UPDATE `+table.name+` i SET amount = i.amount + f.amount
+			 FROM `+table.name+` f
+			 WHERE f.user_id = $1 AND i.user_id = $2 AND i.`+table.key,
+			fromID, intoID,
+		)
+		batch.Queue(
+			`DELETE FROM `+table.name+` f
+			 WHERE f.user_id = $1
+			 AND EXISTS (SELECT 1 FROM `+table.name+` i WHERE i.user_id = $2 AND i.`+table.key+`)`,
+			fromID, intoID,
+		)
+		batch.Queue(`UPDATE `+table.name+` SET user_id = $2 WHERE user_id = $1`, fromID, intoID)
+	}
+
+	// Weights an expense was split with are added up the same way
+	batch.Queue(
+		`UPDATE expense_weights i SET weight = i.weight + f.weight
+		 FROM expense_weights f
+		 WHERE f.user_id = $1 AND i.user_id = $2 AND i.expense_id = f.expense_id`,
+		fromID, intoID,
+	)
+	batch.Queue(
+		`DELETE FROM expense_weights f
+		 WHERE f.user_id = $1
+		 AND EXISTS (SELECT 1 FROM expense_weights i WHERE i.user_id = $2 AND i.expense_id = f.expense_id)`,
+		fromID, intoID,
+	)
+	batch.Queue(`UPDATE expense_weights SET user_id = $2 WHERE user_id = $1`, fromID, intoID)
+
+	// Where both are in a group, intoID keeps the higher of the two roles, and
+	// stays a current member if either was one
+	batch.Queue(
+		`UPDATE group_members i SET role = f.role
+		 FROM group_members f
+		 WHERE f.user_id = $1 AND i.user_id = $2 AND i.group_id = f.group_id AND f.left_at IS NULL
+		 AND (i.left_at IS NOT NULL OR array_position($3::text[], f.role) < array_position($3::text[], i.role))`,
+		fromID, intoID, []string{models.RoleOwner, models.RoleAdmin, models.RoleMember, models.RoleViewer},
+	)
+	batch.Queue(
+		`UPDATE group_members i SET left_at = NULL
+		 FROM group_members f
+		 WHERE f.user_id = $1 AND i.user_id = $2 AND i.group_id = f.group_id AND f.left_at IS NULL`,
+		fromID, intoID,
+	)
+
+	// Rows keyed by user where intoID's own row wins
+	for _, table := range []struct{ name, key string }{
+		{"group_members", "group_id"},
+		{"group_weights", "group_id"},
+		{"expense_confirmations", "expense_id"},
+	} {
+		batch.Queue(
+			`DELETE FROM `+table.name+` f
+			 WHERE f.user_id = $1
+			 AND EXISTS (SELECT 1 FROM `+table.name+` i WHERE i.user_id = $2 AND i.`+table.key+` = f.`+table.key+`)`,
+			fromID, intoID,
+		)
+		batch.Queue(`UPDATE `+table.name+` SET user_id = $2 WHERE user_id = $1`, fromID, intoID)
+	}
+
+	batch.Queue(`UPDATE expenses SET added_by = $2 WHERE added_by = $1`, fromID, intoID)
+	batch.Queue(`UPDATE expense_templates SET created_by = $2 WHERE created_by = $1`, fromID, intoID)
+	batch.Queue(`UPDATE groups SET created_by = $2 WHERE created_by = $1`, fromID, intoID)
+	batch.Queue(`UPDATE groups SET pending_owner_id = $2 WHERE pending_owner_id = $1`, fromID, intoID)
+	batch.Queue(
+		`UPDATE groups g SET pending_owner_id = NULL
+		 WHERE g.pending_owner_id = $1
+		 AND EXISTS (SELECT 1 FROM group_members m WHERE m.group_id = g.group_id AND m.user_id = $1 AND m.role = $2)`,
+		intoID, models.RoleOwner,
+	)
+	batch.Queue(`UPDATE group_events SET actor_id = $2 WHERE actor_id = $1`, fromID, intoID)
+	batch.Queue(`UPDATE group_events SET user_id = $2 WHERE user_id = $1`, fromID, intoID)
+	batch.Queue(`UPDATE user_identities SET user_id = $2 WHERE user_id = $1`, fromID, intoID)
+	batch.Queue(`UPDATE group_invites SET created_by = $2 WHERE created_by = $1`, fromID, intoID)
+	batch.Queue(`UPDATE group_email_invites SET invited_by = $2 WHERE invited_by = $1`, fromID, intoID)
+	batch.Queue(`UPDATE guest_claim_tokens SET created_by = $2 WHERE created_by = $1`, fromID, intoID)
+
+	br := tx.SendBatch(ctx, batch)
+	for range batch.Len() {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	if err := br.Close(); err != nil {
+		return err
+	}
+
+	// Whoever adds an expense never confirms their own share
+	rows, err := tx.Query(
+		ctx,
+		`DELETE FROM expense_confirmations c
+		 USING expenses e
+		 WHERE e.expense_id = c.expense_id AND c.user_id = $1 AND e.added_by = $1
+		 RETURNING c.expense_id`,
+		intoID,
+	)
+	if err != nil {
+		return err
+	}
+	expenseIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, expenseID := range expenseIDs {
+		if _, err := refreshExpenseStatus(ctx, tx, expenseID); err != nil {
+			return err
+		}
+	}
+
+	// Accounts merged into fromID earlier now lead to intoID too
+	_, err = tx.Exec(ctx, `UPDATE user_redirects SET merged_into = $2 WHERE merged_into = $1`, fromID, intoID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM users WHERE user_id = $1`, fromID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO user_redirects (user_id, merged_into, merged_at) VALUES ($1, $2, $3)`,
+		fromID, intoID, time.Now(),
+	)
+	return err
+}
+
+// UserRedirect returns the account a merged account was merged into.
+func UserRedirect(ctx context.Context, pool *pgxpool.Pool, userID string) (string, error) {
+	var mergedInto string
+	err := pool.QueryRow(ctx, `SELECT merged_into FROM user_redirects WHERE user_id = $1`, userID).Scan(&mergedInto)
+	if err == pgx.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return mergedInto, err
+}
+
+// DeleteUser anonymizes an account instead of deleting the row, since deleting it
+// would cascade to the user's splits and unbalance every group they were in.
+// Name and email are replaced with a tombstone, credentials, sessions and tokens
+// are removed, and groups only the user was in are deleted. The user becomes a
+// former member of the other groups and keeps their splits, so the others still
+// see what is owed.
+func DeleteUser(ctx context.Context, pool *pgxpool.Pool, userID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE users SET
+			user_name = $2,
+			email = $3,
+			password_hash = NULL,
+			email_verified = FALSE,
+			totp_secret = NULL,
+			totp_enabled = FALSE,
+			deleted_at = $4
+		 WHERE user_id = $1 AND deleted_at IS NULL`,
+		userID, DeletedUserName, fmt.Sprintf("deleted+%s@deleted.invalid", userID), time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	batch.Queue(`DELETE FROM user_identities WHERE user_id = $1`, userID)
+	batch.Queue(`DELETE FROM personal_access_tokens WHERE user_id = $1`, userID)
+	batch.Queue(`DELETE FROM password_reset_tokens WHERE user_id = $1`, userID)
+	batch.Queue(`DELETE FROM email_verification_tokens WHERE user_id = $1`, userID)
+	batch.Queue(`DELETE FROM token_families WHERE user_id = $1`, userID)
+	// Groups nobody else is in only hold the user's own data
+	batch.Queue(
+		`DELETE FROM groups g
+		 WHERE EXISTS (SELECT 1 FROM group_members gm WHERE gm.group_id = g.group_id AND gm.user_id = $1)
+		 AND NOT EXISTS (SELECT 1 FROM group_members gm WHERE gm.group_id = g.group_id AND gm.user_id <> $1)`,
+		userID,
+	)
+	br := tx.SendBatch(ctx, batch)
+	for range batch.Len() {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	if err := br.Close(); err != nil {
+		return err
+	}
+
+	// The account leaves the groups it was in, so nobody adds it to new expenses
+	rows, err := tx.Query(
+		ctx,
+		`SELECT group_id FROM group_members WHERE user_id = $1 AND left_at IS NULL`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	groupIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, groupID := range groupIDs {
+		if _, err := leaveGroup(ctx, tx, groupID, userID, userID, ""); err != nil {
+			return err
+		}
+	}
+
+	// A deleted account can't answer, so its open confirmations no longer hold expenses back
+	rows, err = tx.Query(
+		ctx,
+		`DELETE FROM expense_confirmations WHERE user_id = $1 AND status = $2 RETURNING expense_id`,
+		userID, models.ConfirmationPending,
+	)
+	if err != nil {
+		return err
+	}
+	expenseIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, expenseID := range expenseIDs {
+		if _, err := refreshExpenseStatus(ctx, tx, expenseID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"context"
+
+	"shared-expenses-app/models"
+	"shared-expenses-app/utils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// GroupBalances returns the net position of every member of a group, and of anyone
+// else who still appears in its splits. Only approved expenses are counted. Income
+// and refunds count against what was paid and owed, since their paid side
+// received money rather than spent it.
+func GroupBalances(ctx context.Context, pool *pgxpool.Pool, groupID string) ([]models.Balance, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT p.user_id,
+			COALESCE(SUM(s.amount * s.sign) FILTER (WHERE s.is_paid), 0),
+			COALESCE(SUM(s.amount * s.sign) FILTER (WHERE NOT s.is_paid), 0)
+		FROM (
+			SELECT user_id FROM group_members WHERE group_id = $1
+			UNION
+			SELECT es.user_id
+			FROM expense_splits es
+			JOIN expenses e ON e.expense_id = es.expense_id
+			WHERE e.group_id = $1
+		) p
+		LEFT JOIN (
+			SELECT es.user_id, es.amount, es.is_paid,
+				CASE WHEN e.kind IN ($3, $4) THEN -1 ELSE 1 END AS sign
+			FROM expense_splits es
+			JOIN expenses e ON e.expense_id = es.expense_id
+			WHERE e.group_id = $1 AND e.status = $2
+		) s ON s.user_id = p.user_id
+		GROUP BY p.user_id
+		ORDER BY p.user_id
+	`, groupID, models.ExpenseStatusApproved, models.ExpenseKindIncome, models.ExpenseKindRefund)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []models.Balance{}
+	for rows.Next() {
+		var b models.Balance
+		if err := rows.Scan(&b.UserID, &b.Paid, &b.Owed); err != nil {
+			return nil, err
+		}
+		b.Net = utils.RoundCents(b.Paid - b.Owed)
+		balances = append(balances, b)
+	}
+	return balances, rows.Err()
+}
+
+// MemberBalance returns the user's net position in the group, counted the same
+// way as GroupBalances.
+func MemberBalance(ctx context.Context, pool *pgxpool.Pool, groupID, userID string) (models.Balance, error) {
+	return memberBalance(ctx, pool, groupID, userID)
+}
+
+// rowQuerier is what memberBalance needs of a pool or a transaction.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+func memberBalance(ctx context.Context, q rowQuerier, groupID, userID string) (models.Balance, error) {
+	b := models.Balance{UserID: userID}
+	err := q.QueryRow(ctx, `
+		SELECT
+			COALESCE(SUM(s.amount * s.sign) FILTER (WHERE s.is_paid), 0),
+			COALESCE(SUM(s.amount * s.sign) FILTER (WHERE NOT s.is_paid), 0)
+		FROM (
+			SELECT es.amount, es.is_paid,
+				CASE WHEN e.kind IN ($4, $5) THEN -1 ELSE 1 END AS sign
+			FROM expense_splits es
+			JOIN expenses e ON e.expense_id = es.expense_id
+			WHERE e.group_id = $1 AND es.user_id = $2 AND e.status = $3
+		) s
+	`, groupID, userID, models.ExpenseStatusApproved, models.ExpenseKindIncome, models.ExpenseKindRefund).Scan(&b.Paid, &b.Owed)
+	if err != nil {
+		return models.Balance{}, err
+	}
+	b.Net = utils.RoundCents(b.Paid - b.Owed)
+	return b, nil
+}
+
+// GroupTotals adds up the approved expenses of a group by kind, so that transfers
+// and income are not reported as spending.
+func GroupTotals(ctx context.Context, pool *pgxpool.Pool, groupID string) (models.GroupTotals, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT kind, COALESCE(SUM(amount), 0)
+		FROM expenses
+		WHERE group_id = $1 AND status = $2
+		GROUP BY kind
+	`, groupID, models.ExpenseStatusApproved)
+	if err != nil {
+		return models.GroupTotals{}, err
+	}
+	defer rows.Close()
+
+	var totals models.GroupTotals
+	for rows.Next() {
+		var kind string
+		var amount float64
+		if err := rows.Scan(&kind, &amount); err != nil {
+			return models.GroupTotals{}, err
+		}
+		switch kind {
+		case models.ExpenseKindSpend:
+			totals.Spending += amount
+		case models.ExpenseKindRefund:
+			totals.Refunds += amount
+			totals.Spending -= amount
+		case models.ExpenseKindTransfer:
+			totals.Transfers += amount
+		case models.ExpenseKindIncome:
+			totals.Income += amount
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return models.GroupTotals{}, err
+	}
+
+	totals.Spending = utils.RoundCents(totals.Spending)
+	totals.Refunds = utils.RoundCents(totals.Refunds)
+	totals.Transfers = utils.RoundCents(totals.Transfers)
+	totals.Income = utils.RoundCents(totals.Income)
+	return totals, nil
+}
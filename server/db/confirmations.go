@@ -0,0 +1,239 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrNoConfirmation is returned when a user is not asked to confirm an expense.
+var ErrNoConfirmation = errors.New("no confirmation requested from user")
+
+// confirmationsNeeded returns the users who have to confirm their share before the
+// expense counts towards balances. It is empty unless the group requires
+// confirmation. Whoever adds the expense never confirms their own share, guests
+// can't sign in to confirm theirs, deleted accounts never will and former members
+// no longer follow the group.
+func confirmationsNeeded(ctx context.Context, tx pgx.Tx, expense models.Expense) ([]string, error) {
+	var required bool
+	err := tx.QueryRow(
+		ctx,
+		`SELECT require_confirmation FROM groups WHERE group_id = $1`,
+		expense.GroupID,
+	).Scan(&required)
+	if err == pgx.ErrNoRows {
+		return nil, errors.New("group not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !required {
+		return []string{}, nil
+	}
+
+	charged := []string{}
+	for userID := range chargedShares(expense) {
+		if userID != expense.AddedBy {
+			charged = append(charged, userID)
+		}
+	}
+
+	rows, err := tx.Query(
+		ctx,
+		`SELECT u.user_id FROM users u
+		 WHERE u.user_id = ANY($1) AND NOT u.is_guest AND u.deleted_at IS NULL
+		 AND NOT EXISTS (
+			SELECT 1 FROM group_members gm
+			WHERE gm.user_id = u.user_id AND gm.group_id = $2 AND gm.left_at IS NOT NULL
+		 )`,
+		charged, expense.GroupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	users, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// chargedShares returns how much each user is charged by the expense: the owed
+// side of spending and transfers, or the receiving (paid) side of income and
+// refunds, since those users now hold money that belongs to the others.
+func chargedShares(expense models.Expense) map[string]float64 {
+	chargedSide := expense.Kind == models.ExpenseKindIncome || expense.Kind == models.ExpenseKindRefund
+
+	shares := map[string]float64{}
+	for _, s := range expense.Splits {
+		if s.IsPaid == chargedSide {
+			shares[s.UserID] += s.Amount
+		}
+	}
+	return shares
+}
+
+// refreshExpenseStatus derives the expense status from its confirmations: any
+// dispute marks it disputed, any open confirmation keeps it pending.
+func refreshExpenseStatus(ctx context.Context, tx pgx.Tx, expenseID string) (string, error) {
+	var status string
+	err := tx.QueryRow(
+		ctx,
+		`UPDATE expenses
+			SET status = CASE
+				WHEN EXISTS (
+					SELECT 1 FROM expense_confirmations WHERE expense_id = $1 AND status = $2
+				) THEN $3
+				WHEN EXISTS (
+					SELECT 1 FROM expense_confirmations WHERE expense_id = $1 AND status = $4
+				) THEN $5
+				ELSE $6
+			END
+			WHERE expense_id = $1
+			RETURNING status`,
+		expenseID,
+		models.ConfirmationDisputed, models.ExpenseStatusDisputed,
+		models.ConfirmationPending, models.ExpenseStatusPending,
+		models.ExpenseStatusApproved,
+	).Scan(&status)
+	if err == pgx.ErrNoRows {
+		return "", errors.New("expense not found")
+	}
+	return status, err
+}
+
+// dropPendingConfirmations removes the confirmations a former member never
+// answered in the group's expenses, so they no longer hold those expenses back.
+func dropPendingConfirmations(ctx context.Context, tx pgx.Tx, groupID, userID string) error {
+	rows, err := tx.Query(
+		ctx,
+		`DELETE FROM expense_confirmations ec
+		 USING expenses e
+		 WHERE e.expense_id = ec.expense_id AND e.group_id = $1 AND ec.user_id = $2 AND ec.status = $3
+		 RETURNING ec.expense_id`,
+		groupID, userID, models.ConfirmationPending,
+	)
+	if err != nil {
+		return err
+	}
+	expenseIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+	for _, expenseID := range expenseIDs {
+		if _, err := refreshExpenseStatus(ctx, tx, expenseID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expenseConfirmations(ctx context.Context, pool *pgxpool.Pool, expenseID string) ([]models.ExpenseConfirmation, error) {
+	rows, err := pool.Query(
+		ctx,
+		`SELECT user_id, status, COALESCE(reason, ''), extract(epoch from updated_at)::bigint
+		 FROM expense_confirmations
+		 WHERE expense_id = $1`,
+		expenseID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var confirmations []models.ExpenseConfirmation
+	for rows.Next() {
+		c := models.ExpenseConfirmation{ExpenseID: expenseID}
+		if err := rows.Scan(&c.UserID, &c.Status, &c.Reason, &c.UpdatedAt); err != nil {
+			return nil, err
+		}
+		confirmations = append(confirmations, c)
+	}
+	return confirmations, rows.Err()
+}
+
+// RespondToExpense records a participant confirming or disputing their share of an
+// expense and returns the resulting expense status.
+func RespondToExpense(ctx context.Context, pool *pgxpool.Pool, expenseID, userID, status, reason string) (string, error) {
+	if status != models.ConfirmationConfirmed && status != models.ConfirmationDisputed {
+		return "", errors.New("invalid confirmation status")
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE expense_confirmations
+			SET status = $3, reason = NULLIF($4, ''), updated_at = $5
+			WHERE expense_id = $1 AND user_id = $2`,
+		expenseID, userID, status, reason, time.Now(),
+	)
+	if err != nil {
+		return "", err
+	}
+	if cmd.RowsAffected() == 0 {
+		return "", ErrNoConfirmation
+	}
+
+	expenseStatus, err := refreshExpenseStatus(ctx, tx, expenseID)
+	if err != nil {
+		return "", err
+	}
+
+	return expenseStatus, tx.Commit(ctx)
+}
+
+// SetRequireConfirmation changes whether new expenses in a group need confirmation.
+// Turning it off approves the pending expenses. Disputed expenses stay disputed
+// until the dispute is resolved.
+func SetRequireConfirmation(ctx context.Context, pool *pgxpool.Pool, groupID string, required bool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE groups SET require_confirmation = $2 WHERE group_id = $1`,
+		groupID, required,
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return errors.New("group not found")
+	}
+
+	if !required {
+		_, err = tx.Exec(
+			ctx,
+			`DELETE FROM expense_confirmations
+			 WHERE expense_id IN (SELECT expense_id FROM expenses WHERE group_id = $1 AND status = $2)`,
+			groupID, models.ExpenseStatusPending,
+		)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(
+			ctx,
+			`UPDATE expenses SET status = $3 WHERE group_id = $1 AND status = $2`,
+			groupID, models.ExpenseStatusPending, models.ExpenseStatusApproved,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"errors"
+	"math"
 	"shared-expenses-app/models"
 	"time"
 
@@ -28,26 +29,138 @@ func CreateExpense(
 	}
 	defer tx.Rollback(ctx)
 
+	expenseID, err := insertExpense(ctx, tx, expense)
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return expenseID, nil
+}
+
+// Sentinel errors for refunds
+var (
+	ErrRefundsExceedExpense = errors.New("refunds exceed expense amount")
+	ErrNotRefundable        = errors.New("only spending can be refunded")
+	ErrExpenseHasRefunds    = errors.New("expense has refunds, its kind can't change")
+)
+
+// CreateRefund records a refund of the expense in refund.RefundOf. The refunded
+// expense stays locked until the refund is in, so concurrent refunds can't add up
+// to more than it, give or take the tolerance.
+func CreateRefund(ctx context.Context, pool *pgxpool.Pool, refund models.Expense, tolerance float64) (string, error) {
+	if refund.RefundOf == nil {
+		return "", errors.New("refund_of required")
+	}
+	if refund.Title == "" {
+		return "", errors.New("title required")
+	}
+	if refund.Amount <= 0 {
+		return "", errors.New("invalid amount")
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	kind, err := lockExpense(ctx, tx, *refund.RefundOf)
+	if err != nil {
+		return "", err
+	}
+	if kind != models.ExpenseKindSpend {
+		return "", ErrNotRefundable
+	}
+
+	refundID, err := insertExpense(ctx, tx, refund)
+	if err != nil {
+		return "", err
+	}
+	if err := checkRefundTotal(ctx, tx, *refund.RefundOf, tolerance); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return refundID, nil
+}
+
+// lockExpense locks an expense row until the end of the transaction and returns
+// its kind.
+func lockExpense(ctx context.Context, tx pgx.Tx, expenseID string) (string, error) {
+	var kind string
+	err := tx.QueryRow(ctx, `SELECT kind FROM expenses WHERE expense_id = $1 FOR UPDATE`, expenseID).Scan(&kind)
+	if err == pgx.ErrNoRows {
+		return "", errors.New("expense not found")
+	}
+	return kind, err
+}
+
+// checkRefundTotal fails with ErrRefundsExceedExpense if the refunds of an
+// expense add up to more than its amount plus the tolerance.
+func checkRefundTotal(ctx context.Context, tx pgx.Tx, expenseID string, tolerance float64) error {
+	var amount, refunded float64
+	err := tx.QueryRow(
+		ctx,
+		`SELECT e.amount, COALESCE((SELECT SUM(r.amount) FROM expenses r WHERE r.refund_of = e.expense_id), 0)
+		FROM expenses e
+		WHERE e.expense_id = $1`,
+		expenseID,
+	).Scan(&amount, &refunded)
+	if err != nil {
+		return err
+	}
+	if refunded > amount+tolerance {
+		return ErrRefundsExceedExpense
+	}
+	return nil
+}
+
+// insertExpense adds the expense with its splits and weights, asking the owers
+// to confirm it where the group requires that.
+func insertExpense(ctx context.Context, tx pgx.Tx, expense models.Expense) (string, error) {
+	// Owers may have to confirm their share first
+	confirmers, err := confirmationsNeeded(ctx, tx, expense)
+	if err != nil {
+		return "", err
+	}
+	status := models.ExpenseStatusApproved
+	if len(confirmers) > 0 {
+		status = models.ExpenseStatusPending
+	}
+
 	// Insert expense details
 	var expenseID string
 	err = tx.QueryRow(
 		ctx,
 		`INSERT INTO expenses (
-			group_id, added_by, title, description, amount,
-			is_incomplete_amount, is_incomplete_split, latitude, longitude, created_at
+			group_id, added_by, title, description, category, amount,
+			is_incomplete_amount, is_incomplete_split, latitude, longitude, created_at, status, split_mode,
+			refund_of, kind
 		)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 		RETURNING expense_id`,
 		expense.GroupID,
 		expense.AddedBy,
 		expense.Title,
 		expense.Description,
+		expense.Category,
 		expense.Amount,
 		expense.IsIncompleteAmount,
 		expense.IsIncompleteSplit,
 		expense.Latitude,
 		expense.Longitude,
 		time.Now(),
+		status,
+		expense.SplitMode,
+		expense.RefundOf,
+		expense.Kind,
 	).Scan(&expenseID)
 	if err != nil {
 		return "", err
@@ -75,15 +188,31 @@ func CreateExpense(
 		}
 		br.Close()
 	}
-	err = tx.Commit(ctx)
-	if err != nil {
+
+	if err := insertExpenseWeights(ctx, tx, expenseID, expense.Weights); err != nil {
 		return "", err
 	}
 
+	for _, userID := range confirmers {
+		_, err = tx.Exec(
+			ctx,
+			`INSERT INTO expense_confirmations (expense_id, user_id, status, updated_at)
+			 VALUES ($1, $2, $3, $4)`,
+			expenseID, userID, models.ConfirmationPending, time.Now(),
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+
 	return expenseID, nil
 }
 
-func UpdateExpense(ctx context.Context, pool *pgxpool.Pool, expense models.Expense) error {
+// UpdateExpense replaces an expense and its splits. Refunds of the expense, or the
+// other refunds of the same expense if it is a refund itself, must still fit in
+// the refunded amount, give or take the refund tolerance, and an expense with
+// refunds keeps its kind.
+func UpdateExpense(ctx context.Context, pool *pgxpool.Pool, expense models.Expense, refundTolerance float64) error {
 	if expense.ExpenseID == "" {
 		return errors.New("expense_id required")
 	}
@@ -100,33 +229,109 @@ func UpdateExpense(ctx context.Context, pool *pgxpool.Pool, expense models.Expen
 	}
 	defer tx.Rollback(ctx)
 
+	// Remember what each user was charged before replacing the splits
+	previous := models.Expense{ExpenseID: expense.ExpenseID}
+	err = tx.QueryRow(
+		ctx,
+		`SELECT kind, refund_of FROM expenses WHERE expense_id = $1`,
+		expense.ExpenseID,
+	).Scan(&previous.Kind, &previous.RefundOf)
+	if err == pgx.ErrNoRows {
+		return errors.New("expense not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	// Lock the refunded expense, so its refunds are checked against concurrent ones
+	refundedID := expense.ExpenseID
+	if previous.RefundOf != nil {
+		refundedID = *previous.RefundOf
+	}
+	if _, err := lockExpense(ctx, tx, refundedID); err != nil {
+		return err
+	}
+
+	// Refunds only make sense against spending
+	if previous.RefundOf == nil && expense.Kind != previous.Kind {
+		var hasRefunds bool
+		err = tx.QueryRow(
+			ctx,
+			`SELECT EXISTS (SELECT 1 FROM expenses WHERE refund_of = $1)`,
+			expense.ExpenseID,
+		).Scan(&hasRefunds)
+		if err != nil {
+			return err
+		}
+		if hasRefunds {
+			return ErrExpenseHasRefunds
+		}
+	}
+	rows, err := tx.Query(
+		ctx,
+		`SELECT user_id, amount, is_paid FROM expense_splits WHERE expense_id = $1`,
+		expense.ExpenseID,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var split models.ExpenseSplit
+		if err := rows.Scan(&split.UserID, &split.Amount, &split.IsPaid); err != nil {
+			rows.Close()
+			return err
+		}
+		previous.Splits = append(previous.Splits, split)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	previousShares := chargedShares(previous)
+	currentShares := chargedShares(expense)
+
 	// Update main expense fields
 	_, err = tx.Exec(
 		ctx,
 		`UPDATE expenses
 			SET title = $2,
 				description = $3,
-				amount = $4,
-				added_by = $5,
-				is_incomplete_amount = $6,
-				is_incomplete_split = $7,
-				latitude = $8,
-				longitude = $9
+				category = $4,
+				amount = $5,
+				added_by = $6,
+				is_incomplete_amount = $7,
+				is_incomplete_split = $8,
+				latitude = $9,
+				longitude = $10,
+				split_mode = $11,
+				kind = $12
 			WHERE expense_id = $1`,
 		expense.ExpenseID,
 		expense.Title,
 		expense.Description,
+		expense.Category,
 		expense.Amount,
 		expense.AddedBy,
 		expense.IsIncompleteAmount,
 		expense.IsIncompleteSplit,
 		expense.Latitude,
 		expense.Longitude,
+		expense.SplitMode,
+		expense.Kind,
 	)
 	if err != nil {
 		return err
 	}
 
+	// Replace the weights snapshot
+	_, err = tx.Exec(ctx, `DELETE FROM expense_weights WHERE expense_id = $1`, expense.ExpenseID)
+	if err != nil {
+		return err
+	}
+	if err := insertExpenseWeights(ctx, tx, expense.ExpenseID, expense.Weights); err != nil {
+		return err
+	}
+
 	// Remove old splits first
 	_, err = tx.Exec(ctx, `DELETE FROM expense_splits WHERE expense_id = $1`, expense.ExpenseID)
 	if err != nil {
@@ -157,9 +362,75 @@ func UpdateExpense(ctx context.Context, pool *pgxpool.Pool, expense models.Expen
 		}
 	}
 
+	// Users whose share changed have to confirm again
+	confirmers, err := confirmationsNeeded(ctx, tx, expense)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`DELETE FROM expense_confirmations WHERE expense_id = $1 AND NOT (user_id = ANY($2))`,
+		expense.ExpenseID, confirmers,
+	)
+	if err != nil {
+		return err
+	}
+	for _, userID := range confirmers {
+		previousShare, ok := previousShares[userID]
+		if ok && math.Abs(previousShare-currentShares[userID]) < 0.005 {
+			// Unchanged share, keep the existing answer if there is one
+			_, err = tx.Exec(
+				ctx,
+				`INSERT INTO expense_confirmations (expense_id, user_id, status, updated_at)
+				 VALUES ($1, $2, $3, $4)
+				 ON CONFLICT DO NOTHING`,
+				expense.ExpenseID, userID, models.ConfirmationPending, time.Now(),
+			)
+		} else {
+			_, err = tx.Exec(
+				ctx,
+				`INSERT INTO expense_confirmations (expense_id, user_id, status, updated_at)
+				 VALUES ($1, $2, $3, $4)
+				 ON CONFLICT (expense_id, user_id)
+				 DO UPDATE SET status = EXCLUDED.status, reason = NULL, updated_at = EXCLUDED.updated_at`,
+				expense.ExpenseID, userID, models.ConfirmationPending, time.Now(),
+			)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := refreshExpenseStatus(ctx, tx, expense.ExpenseID); err != nil {
+		return err
+	}
+
+	if err := checkRefundTotal(ctx, tx, refundedID, refundTolerance); err != nil {
+		return err
+	}
+
 	return tx.Commit(ctx)
 }
 
+// ExpenseGroup returns the group an expense belongs to.
+func ExpenseGroup(ctx context.Context, pool *pgxpool.Pool, expenseID string) (string, error) {
+	var groupID string
+	err := pool.QueryRow(ctx, `SELECT group_id FROM expenses WHERE expense_id = $1`, expenseID).Scan(&groupID)
+	if err == pgx.ErrNoRows {
+		return "", errors.New("expense not found")
+	}
+	return groupID, err
+}
+
+// ExpenseOwner returns the group an expense belongs to and the user who added it.
+func ExpenseOwner(ctx context.Context, pool *pgxpool.Pool, expenseID string) (string, string, error) {
+	var groupID, addedBy string
+	err := pool.QueryRow(ctx, `SELECT group_id, added_by FROM expenses WHERE expense_id = $1`, expenseID).Scan(&groupID, &addedBy)
+	if err == pgx.ErrNoRows {
+		return "", "", errors.New("expense not found")
+	}
+	return groupID, addedBy, err
+}
+
 func GetExpense(ctx context.Context, pool *pgxpool.Pool, expenseID string) (models.Expense, error) {
 	var expense models.Expense
 
@@ -170,12 +441,17 @@ func GetExpense(ctx context.Context, pool *pgxpool.Pool, expenseID string) (mode
 			added_by,
 			title,
 			description,
+			category,
 			extract(epoch from created_at)::bigint,
 			amount,
 			is_incomplete_amount,
 			is_incomplete_split,
 			latitude,
-			longitude
+			longitude,
+			status,
+			split_mode,
+			refund_of,
+			kind
 		 FROM expenses
 		 WHERE expense_id = $1`,
 		expenseID,
@@ -185,12 +461,17 @@ func GetExpense(ctx context.Context, pool *pgxpool.Pool, expenseID string) (mode
 		&expense.AddedBy,
 		&expense.Title,
 		&expense.Description,
+		&expense.Category,
 		&expense.CreatedAt,
 		&expense.Amount,
 		&expense.IsIncompleteAmount,
 		&expense.IsIncompleteSplit,
 		&expense.Latitude,
 		&expense.Longitude,
+		&expense.Status,
+		&expense.SplitMode,
+		&expense.RefundOf,
+		&expense.Kind,
 	)
 	if err == pgx.ErrNoRows {
 		return models.Expense{}, errors.New("expense not found")
@@ -214,10 +495,58 @@ func GetExpense(ctx context.Context, pool *pgxpool.Pool, expenseID string) (mode
 		}
 		expense.Splits = append(expense.Splits, split)
 	}
+	rows.Close()
+
+	expense.Confirmations, err = expenseConfirmations(ctx, pool, expenseID)
+	if err != nil {
+		return models.Expense{}, err
+	}
+
+	expense.Weights, err = expenseWeights(ctx, pool, expenseID)
+	if err != nil {
+		return models.Expense{}, err
+	}
 
 	return expense, nil
 }
 
+// ExpenseRefunds returns the refunds recorded against an expense, oldest first.
+func ExpenseRefunds(ctx context.Context, pool *pgxpool.Pool, expenseID string) ([]models.Expense, error) {
+	rows, err := pool.Query(
+		ctx,
+		`SELECT expense_id FROM expenses WHERE refund_of = $1 ORDER BY created_at`,
+		expenseID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var refundIDs []string
+	for rows.Next() {
+		var refundID string
+		if err := rows.Scan(&refundID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		refundIDs = append(refundIDs, refundID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	refunds := make([]models.Expense, 0, len(refundIDs))
+	for _, refundID := range refundIDs {
+		refund, err := GetExpense(ctx, pool, refundID)
+		if err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, refund)
+	}
+
+	return refunds, nil
+}
+
 func DeleteExpense(ctx context.Context, pool *pgxpool.Pool, expenseID string) error {
 	tx, err := pool.Begin(ctx)
 	if err != nil {
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"errors"
+	"math"
 	"time"
 
 	"shared-expenses-app/models"
@@ -11,6 +12,9 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// ErrGroupNotFound is returned when a group does not exist.
+var ErrGroupNotFound = errors.New("group not found")
+
 // CreateGroup inserts a new group into the database and adds the owner as a member.
 func CreateGroup(ctx context.Context, pool *pgxpool.Pool, name, description, ownerUserID string) (string, error) {
 	tx, err := pool.Begin(ctx)
@@ -39,9 +43,9 @@ func CreateGroup(ctx context.Context, pool *pgxpool.Pool, name, description, own
 
 	_, err = tx.Exec(
 		ctx,
-		`INSERT INTO group_members (user_id, group_id, joined_at)
-		 VALUES ($1, $2, $3)`,
-		ownerUserID, groupID, time.Now(),
+		`INSERT INTO group_members (user_id, group_id, role, joined_at)
+		 VALUES ($1, $2, $3, $4)`,
+		ownerUserID, groupID, models.RoleOwner, time.Now(),
 	)
 	if err != nil {
 		return "", err
@@ -54,21 +58,71 @@ func CreateGroup(ctx context.Context, pool *pgxpool.Pool, name, description, own
 	return groupID, nil
 }
 
-// GetGroupCreator returns only the creator ID of a group.
-func GetGroupCreator(ctx context.Context, pool *pgxpool.Pool, groupID string) (string, error) {
-	var creatorID string
+// GroupRole returns the user's role in the group, empty if the user isn't a
+// member or is a former member.
+func GroupRole(ctx context.Context, pool *pgxpool.Pool, groupID, userID string) (string, error) {
+	var role string
 	err := pool.QueryRow(
 		ctx,
-		`SELECT created_by FROM groups WHERE group_id = $1`,
-		groupID,
-	).Scan(&creatorID)
+		`SELECT COALESCE(gm.role, '')
+		 FROM groups g
+		 LEFT JOIN group_members gm ON gm.group_id = g.group_id AND gm.user_id = $2 AND gm.left_at IS NULL
+		 WHERE g.group_id = $1`,
+		groupID, userID,
+	).Scan(&role)
 	if err == pgx.ErrNoRows {
-		return "", errors.New("group not found")
+		return "", ErrGroupNotFound
 	}
 	if err != nil {
 		return "", err
 	}
-	return creatorID, nil
+	return role, nil
+}
+
+// SetMemberRole changes the role of a member of the group, recording who changed it.
+func SetMemberRole(ctx context.Context, pool *pgxpool.Pool, groupID, actorID, userID, role string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var previous string
+	err = tx.QueryRow(
+		ctx,
+		`SELECT role FROM group_members WHERE group_id = $1 AND user_id = $2 AND left_at IS NULL FOR UPDATE`,
+		groupID, userID,
+	).Scan(&previous)
+	if err == pgx.ErrNoRows {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+	if previous == role {
+		return nil
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE group_members SET role = $3 WHERE group_id = $1 AND user_id = $2`,
+		groupID, userID, role,
+	)
+	if err != nil {
+		return err
+	}
+	err = recordGroupEvent(ctx, tx, models.GroupEvent{
+		GroupID: groupID,
+		ActorID: &actorID,
+		Kind:    models.GroupEventRoleChanged,
+		UserID:  &userID,
+		Data:    map[string]string{"from": previous, "to": role},
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
 }
 
 func GetGroup(ctx context.Context, pool *pgxpool.Pool, groupID string) (models.Group, error) {
@@ -76,22 +130,25 @@ func GetGroup(ctx context.Context, pool *pgxpool.Pool, groupID string) (models.G
 
 	err := pool.QueryRow(
 		ctx,
-		`SELECT group_id, group_name, description, created_by, extract(epoch from created_at)::bigint
+		`SELECT group_id, group_name, description, created_by, extract(epoch from created_at)::bigint,
+			require_confirmation, pending_owner_id
 		FROM groups
 		WHERE group_id = $1`,
 		groupID,
-	).Scan(&group.GroupID, &group.Name, &group.Description, &group.CreatedBy, &group.CreatedAt)
+	).Scan(&group.GroupID, &group.Name, &group.Description, &group.CreatedBy, &group.CreatedAt,
+		&group.RequireConfirmation, &group.PendingOwner)
 	if err == pgx.ErrNoRows {
-		return models.Group{}, errors.New("group not found")
+		return models.Group{}, ErrGroupNotFound
 	}
 	if err != nil {
 		return models.Group{}, err
 	}
 
-	// Fetch group members
+	// Fetch group members, current and former
 	rows, err := pool.Query(
 		ctx,
-		`SELECT u.user_id, u.user_name, u.email, u.is_guest, extract(epoch from gm.joined_at)::bigint
+		`SELECT u.user_id, u.user_name, u.email, u.is_guest, u.deleted_at IS NOT NULL, gm.role,
+			extract(epoch from gm.joined_at)::bigint, extract(epoch from gm.left_at)::bigint
 		 FROM group_members gm
 		 JOIN users u ON gm.user_id = u.user_id
 		 WHERE gm.group_id = $1`,
@@ -104,16 +161,28 @@ func GetGroup(ctx context.Context, pool *pgxpool.Pool, groupID string) (models.G
 
 	for rows.Next() {
 		var member models.GroupUser
-		err := rows.Scan(&member.UserID, &member.Name, &member.Email, &member.Guest, &member.JoinedAt)
+		err := rows.Scan(&member.UserID, &member.Name, &member.Email, &member.Guest, &member.Deleted, &member.Role,
+			&member.JoinedAt, &member.LeftAt)
 		if err != nil {
 			return models.Group{}, err
 		}
-		group.Members = append(group.Members, member)
+		if member.LeftAt != nil {
+			group.FormerMembers = append(group.FormerMembers, member)
+		} else {
+			group.Members = append(group.Members, member)
+		}
 	}
 
 	return group, nil
 }
 
+// rejoinOnConflict ends an insert into group_members so that former members
+// added again come back as current members with the default role, while current
+// members are left alone.
+const rejoinOnConflict = `ON CONFLICT (user_id, group_id) DO UPDATE
+	SET left_at = NULL, role = DEFAULT, joined_at = now()
+	WHERE group_members.left_at IS NOT NULL`
+
 // AddGroupMembers adds multiple users to a group.
 func AddGroupMembers(ctx context.Context, pool *pgxpool.Pool, groupID string, userIDs []string) error {
 	if len(userIDs) == 0 {
@@ -125,7 +194,7 @@ func AddGroupMembers(ctx context.Context, pool *pgxpool.Pool, groupID string, us
 		batch.Queue(
 			`INSERT INTO group_members (user_id, group_id)
 			 VALUES ($1, $2)
-			 ON CONFLICT DO NOTHING`,
+			 `+rejoinOnConflict,
 			userID, groupID,
 		)
 	}
@@ -149,7 +218,7 @@ func AddGroupMember(ctx context.Context, pool *pgxpool.Pool, groupID, userID str
 		ctx,
 		`INSERT INTO group_members (user_id, group_id)
 		VALUES ($1, $2)
-		ON CONFLICT DO NOTHING`,
+		`+rejoinOnConflict,
 		userID, groupID)
 	if err != nil {
 		return err
@@ -157,45 +226,228 @@ func AddGroupMember(ctx context.Context, pool *pgxpool.Pool, groupID, userID str
 	return nil
 }
 
+// RemoveGroupMember lets a user leave a group.
 func RemoveGroupMember(ctx context.Context, pool *pgxpool.Pool, groupID, userID string) error {
-	_, err := pool.Exec(
-		ctx,
-		`DELETE FROM group_members
-	WHERE user_id = $1 AND group_id = $2`,
-		userID, groupID)
-	if err == pgx.ErrNoRows {
-		return errors.New("member not found in group")
+	_, err := RemoveGroupMembers(ctx, pool, groupID, userID, []string{userID}, "")
+	return err
+}
+
+// RemoveGroupMembers turns users into former members of a group, recording who
+// removed them. Former members keep their splits, so past expenses don't change,
+// and are taken out of the group's templates. Confirmations they never answered
+// are dropped, unless reassignTo is set. Then that member takes over what they
+// had outstanding: their splits in expenses that aren't approved yet and in
+// templates, and their balance through a transfer. Returns the users who had
+// anything to take over.
+func RemoveGroupMembers(ctx context.Context, pool *pgxpool.Pool, groupID, actorID string, userIDs []string, reassignTo string) ([]string, error) {
+	if len(userIDs) == 0 {
+		return nil, errors.New("no user IDs provided")
 	}
+
+	tx, err := pool.Begin(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer tx.Rollback(ctx)
+
+	reassigned := []string{}
+	for _, userID := range userIDs {
+		tookOver, err := leaveGroup(ctx, tx, groupID, actorID, userID, reassignTo)
+		if err != nil {
+			return nil, err
+		}
+		if tookOver {
+			reassigned = append(reassigned, userID)
+		}
+	}
+
+	return reassigned, tx.Commit(ctx)
 }
 
-// RemoveGroupMembers removes multiple users from a group.
-func RemoveGroupMembers(ctx context.Context, pool *pgxpool.Pool, groupID string, userIDs []string) error {
-	if len(userIDs) == 0 {
-		return errors.New("no user IDs provided")
+// leaveGroup makes userID a former member of the group, as RemoveGroupMembers
+// describes. Returns whether reassignTo took anything over, and false without
+// error if the user wasn't a current member.
+func leaveGroup(ctx context.Context, tx pgx.Tx, groupID, actorID, userID, reassignTo string) (bool, error) {
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE group_members SET left_at = $3
+		 WHERE user_id = $1 AND group_id = $2 AND left_at IS NULL`,
+		userID, groupID, time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	if cmd.RowsAffected() == 0 {
+		return false, nil
 	}
 
 	batch := &pgx.Batch{}
-	for _, userID := range userIDs {
-		batch.Queue(
-			`DELETE FROM group_members
-			 WHERE user_id = $1 AND group_id = $2`,
-			userID, groupID,
-		)
+	batch.Queue(
+		`DELETE FROM group_weights
+		 WHERE user_id = $1 AND group_id = $2`,
+		userID, groupID,
+	)
+	batch.Queue(
+		`UPDATE groups SET pending_owner_id = NULL
+		 WHERE group_id = $2 AND pending_owner_id = $1`,
+		userID, groupID,
+	)
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return false, err
+	}
+	if err := leaveTemplates(ctx, tx, groupID, userID, reassignTo); err != nil {
+		return false, err
 	}
 
-	br := pool.SendBatch(ctx, batch)
-	defer br.Close()
-
-	for range userIDs {
-		_, err := br.Exec()
+	event := models.GroupEvent{
+		GroupID: groupID,
+		ActorID: &actorID,
+		Kind:    models.GroupEventMemberRemoved,
+		UserID:  &userID,
+	}
+	if userID == actorID {
+		event.Kind = models.GroupEventMemberLeft
+	}
+	tookOver := false
+	if reassignTo != "" {
+		moved, err := reassignOpenSplits(ctx, tx, groupID, userID, reassignTo)
 		if err != nil {
-			return err
+			return false, err
+		}
+		transferID, err := takeOverBalance(ctx, tx, groupID, actorID, userID, reassignTo)
+		if err != nil {
+			return false, err
 		}
+		if moved > 0 || transferID != "" {
+			event.Data = map[string]string{"reassigned_to": reassignTo}
+			if transferID != "" {
+				event.Data["transfer_id"] = transferID
+			}
+			tookOver = true
+		}
+	} else if err := dropPendingConfirmations(ctx, tx, groupID, userID); err != nil {
+		return false, err
+	}
+	if err := recordGroupEvent(ctx, tx, event); err != nil {
+		return false, err
 	}
+	return tookOver, nil
+}
 
-	return nil
+// reassignOpenSplits moves fromID's splits in the group's expenses that aren't
+// approved yet to toID, adding them up where toID already has a share. toID then
+// has to confirm their new share, as after any other change to it. Returns how
+// many expenses changed.
+func reassignOpenSplits(ctx context.Context, tx pgx.Tx, groupID, fromID, toID string) (int, error) {
+	rows, err := tx.Query(
+		ctx,
+		`SELECT DISTINCT e.expense_id
+		 FROM expenses e
+		 JOIN expense_splits es ON es.expense_id = e.expense_id
+		 WHERE e.group_id = $1 AND es.user_id = $2 AND e.status <> $3`,
+		groupID, fromID, models.ExpenseStatusApproved,
+	)
+	if err != nil {
+		return 0, err
+	}
+	expenseIDs, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return 0, err
+	}
+	if len(expenseIDs) == 0 {
+		return 0, nil
+	}
+
+	batch := &pgx.Batch{}
+	batch.Queue(
+		`UPDATE expense_splits i SET amount = i.amount + f.amount
+		 FROM expense_splits f
+		 WHERE f.user_id = $1 AND i.user_id = $2 AND i.expense_id = f.expense_id AND i.is_paid = f.is_paid
+		 AND f.expense_id = ANY($3)`,
+		fromID, toID, expenseIDs,
+	)
+	batch.Queue(
+		`DELETE FROM expense_splits f
+		 WHERE f.user_id = $1 AND f.expense_id = ANY($3)
+		 AND EXISTS (
+			SELECT 1 FROM expense_splits i
+			WHERE i.user_id = $2 AND i.expense_id = f.expense_id AND i.is_paid = f.is_paid
+		 )`,
+		fromID, toID, expenseIDs,
+	)
+	batch.Queue(`UPDATE expense_splits SET user_id = $2 WHERE user_id = $1 AND expense_id = ANY($3)`, fromID, toID, expenseIDs)
+	batch.Queue(
+		`UPDATE expense_weights i SET weight = i.weight + f.weight
+		 FROM expense_weights f
+		 WHERE f.user_id = $1 AND i.user_id = $2 AND i.expense_id = f.expense_id
+		 AND f.expense_id = ANY($3)`,
+		fromID, toID, expenseIDs,
+	)
+	batch.Queue(
+		`DELETE FROM expense_weights f
+		 WHERE f.user_id = $1 AND f.expense_id = ANY($3)
+		 AND EXISTS (SELECT 1 FROM expense_weights i WHERE i.user_id = $2 AND i.expense_id = f.expense_id)`,
+		fromID, toID, expenseIDs,
+	)
+	batch.Queue(`UPDATE expense_weights SET user_id = $2 WHERE user_id = $1 AND expense_id = ANY($3)`, fromID, toID, expenseIDs)
+	batch.Queue(`DELETE FROM expense_confirmations WHERE user_id = $1 AND expense_id = ANY($2)`, fromID, expenseIDs)
+
+	// Like confirmationsNeeded: only charged shares are confirmed, never by
+	// whoever added the expense or by guests
+	batch.Queue(
+		`INSERT INTO expense_confirmations (expense_id, user_id, status, updated_at)
+		 SELECT e.expense_id, u.user_id, $3, $4
+		 FROM expenses e
+		 JOIN users u ON u.user_id = $2
+		 WHERE e.expense_id = ANY($1) AND e.added_by IS DISTINCT FROM u.user_id AND NOT u.is_guest
+		 AND EXISTS (
+			SELECT 1 FROM expense_splits s
+			WHERE s.expense_id = e.expense_id AND s.user_id = u.user_id AND s.is_paid = (e.kind IN ($5, $6))
+		 )
+		 ON CONFLICT (expense_id, user_id)
+		 DO UPDATE SET status = EXCLUDED.status, reason = NULL, updated_at = EXCLUDED.updated_at`,
+		expenseIDs, toID, models.ConfirmationPending, time.Now(), models.ExpenseKindIncome, models.ExpenseKindRefund,
+	)
+	if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+		return 0, err
+	}
+
+	for _, expenseID := range expenseIDs {
+		if _, err := refreshExpenseStatus(ctx, tx, expenseID); err != nil {
+			return 0, err
+		}
+	}
+	return len(expenseIDs), nil
+}
+
+// takeOverBalance records a transfer that moves fromID's approved balance in the
+// group to toID, so toID is owed or owes what fromID was. Past expenses are left
+// as they are. Returns the transfer's ID, empty if fromID was settled.
+func takeOverBalance(ctx context.Context, tx pgx.Tx, groupID, actorID, fromID, toID string) (string, error) {
+	balance, err := memberBalance(ctx, tx, groupID, fromID)
+	if err != nil {
+		return "", err
+	}
+	if balance.Net == 0 {
+		return "", nil
+	}
+
+	// The sender's balance goes up by the amount and the recipient's goes down
+	sender, recipient := toID, fromID
+	if balance.Net < 0 {
+		sender, recipient = fromID, toID
+	}
+	amount := math.Abs(balance.Net)
+	return insertExpense(ctx, tx, models.Expense{
+		GroupID:   groupID,
+		AddedBy:   actorID,
+		Title:     "Balance taken over from a former member",
+		Amount:    amount,
+		Kind:      models.ExpenseKindTransfer,
+		SplitMode: models.SplitModeExact,
+		Splits: []models.ExpenseSplit{
+			{UserID: sender, Amount: amount, IsPaid: true},
+			{UserID: recipient, Amount: amount},
+		},
+	})
 }
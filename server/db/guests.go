@@ -0,0 +1,130 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/models"
+	"shared-expenses-app/utils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrGuestNotFound     = errors.New("guest not found")
+	ErrInvalidClaimToken = errors.New("invalid or expired claim token")
+)
+
+// CreateGuest creates a name-only guest and adds it to the group. Guests have no
+// email or password, so they can be split with but can't sign in.
+func CreateGuest(ctx context.Context, pool *pgxpool.Pool, groupID, name string) (models.User, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return models.User{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	guest, err := insertGuest(ctx, tx, groupID, name)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	return guest, tx.Commit(ctx)
+}
+
+func insertGuest(ctx context.Context, tx pgx.Tx, groupID, name string) (models.User, error) {
+	guest := models.User{Name: name, Guest: true}
+	err := tx.QueryRow(
+		ctx,
+		`INSERT INTO users (user_name, is_guest, created_at)
+		 VALUES ($1, TRUE, $2)
+		 RETURNING user_id, extract(epoch from created_at)::bigint`,
+		name, time.Now(),
+	).Scan(&guest.UserID, &guest.CreatedAt)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO group_members (user_id, group_id, joined_at) VALUES ($1, $2, $3)`,
+		guest.UserID, groupID, time.Now(),
+	)
+	if err != nil {
+		return models.User{}, err
+	}
+
+	return guest, nil
+}
+
+// ForeignGuests returns which of the given users are guests that were never in
+// the group. Guests belong to the group that created them: whoever can claim a
+// guest takes over all of its groups.
+func ForeignGuests(ctx context.Context, pool *pgxpool.Pool, groupID string, userIDs []string) ([]string, error) {
+	if len(userIDs) == 0 {
+		return []string{}, nil
+	}
+
+	rows, err := pool.Query(
+		ctx,
+		`SELECT u.user_id FROM users u
+		 WHERE u.user_id = ANY($1) AND u.is_guest
+		 AND NOT EXISTS (SELECT 1 FROM group_members gm WHERE gm.user_id = u.user_id AND gm.group_id = $2)`,
+		utils.GetUniqueUserIDs(userIDs), groupID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// CreateGuestClaim stores a token that lets a registered user take over the guest.
+func CreateGuestClaim(ctx context.Context, pool *pgxpool.Pool, guestID, createdBy, tokenHash string, expiresAt time.Time) error {
+	cmd, err := pool.Exec(
+		ctx,
+		`INSERT INTO guest_claim_tokens (token_hash, guest_id, created_by, created_at, expires_at)
+		 SELECT $1, user_id, $3, $4, $5 FROM users WHERE user_id = $2 AND is_guest`,
+		tokenHash, guestID, createdBy, time.Now(), expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrGuestNotFound
+	}
+	return nil
+}
+
+// ClaimGuest spends a claim token and merges its guest into the user, who takes
+// over the guest's memberships and splits. Returns the guest's ID.
+func ClaimGuest(ctx context.Context, pool *pgxpool.Pool, tokenHash, userID string) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var guestID string
+	err = tx.QueryRow(
+		ctx,
+		`SELECT t.guest_id FROM guest_claim_tokens t
+		 JOIN users u ON u.user_id = t.guest_id
+		 WHERE t.token_hash = $1 AND t.used_at IS NULL AND t.expires_at > now() AND u.is_guest
+		 FOR UPDATE OF t, u`,
+		tokenHash,
+	).Scan(&guestID)
+	if err == pgx.ErrNoRows {
+		return "", ErrInvalidClaimToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if err := mergeUsers(ctx, tx, guestID, userID); err != nil {
+		return "", err
+	}
+
+	return guestID, tx.Commit(ctx)
+}
@@ -0,0 +1,52 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"shared-expenses-app/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// recordGroupEvent adds an entry to the group's history, in the transaction
+// making the change so the two can't disagree.
+func recordGroupEvent(ctx context.Context, tx pgx.Tx, event models.GroupEvent) error {
+	data := event.Data
+	if data == nil {
+		data = map[string]string{}
+	}
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO group_events (group_id, actor_id, kind, user_id, data, created_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		event.GroupID, event.ActorID, event.Kind, event.UserID, data, time.Now(),
+	)
+	return err
+}
+
+// GroupHistory returns the group's history, newest first.
+func GroupHistory(ctx context.Context, pool *pgxpool.Pool, groupID string) ([]models.GroupEvent, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT event_id, group_id, actor_id, kind, user_id, data, extract(epoch from created_at)::bigint
+		FROM group_events
+		WHERE group_id = $1
+		ORDER BY created_at DESC
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []models.GroupEvent{}
+	for rows.Next() {
+		var e models.GroupEvent
+		err := rows.Scan(&e.EventID, &e.GroupID, &e.ActorID, &e.Kind, &e.UserID, &e.Data, &e.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrInvalidLoginState is returned for unknown, used or expired OIDC login states.
+var ErrInvalidLoginState = errors.New("invalid or expired login state")
+
+// OIDCLoginState is what is remembered about a login while the user is at the provider.
+type OIDCLoginState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	DeviceName   string
+}
+
+// CreateLoginState stores a pending OIDC login, clearing out expired ones.
+func CreateLoginState(ctx context.Context, pool *pgxpool.Pool, stateHash string, state OIDCLoginState, expiresAt time.Time) error {
+	_, err := pool.Exec(ctx, `DELETE FROM oidc_login_states WHERE expires_at < now()`)
+	if err != nil {
+		return err
+	}
+
+	_, err = pool.Exec(
+		ctx,
+		`INSERT INTO oidc_login_states (state_hash, provider, nonce, code_verifier, device_name, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		stateHash, state.Provider, state.Nonce, state.CodeVerifier, state.DeviceName, time.Now(), expiresAt,
+	)
+	return err
+}
+
+// TakeLoginState removes and returns a pending OIDC login, so each state is used once.
+func TakeLoginState(ctx context.Context, pool *pgxpool.Pool, stateHash string) (OIDCLoginState, error) {
+	var state OIDCLoginState
+	err := pool.QueryRow(
+		ctx,
+		`DELETE FROM oidc_login_states
+		 WHERE state_hash = $1 AND expires_at > now()
+		 RETURNING provider, nonce, code_verifier, device_name`,
+		stateHash,
+	).Scan(&state.Provider, &state.Nonce, &state.CodeVerifier, &state.DeviceName)
+	if err == pgx.ErrNoRows {
+		return OIDCLoginState{}, ErrInvalidLoginState
+	}
+	return state, err
+}
+
+// UserForIdentity returns the user linked to a provider's subject, or ErrUserNotFound.
+func UserForIdentity(ctx context.Context, pool *pgxpool.Pool, provider, subject string) (string, error) {
+	var userID string
+	err := pool.QueryRow(
+		ctx,
+		`SELECT user_id FROM user_identities WHERE provider = $1 AND subject = $2`,
+		provider, subject,
+	).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return "", ErrUserNotFound
+	}
+	return userID, err
+}
+
+// LinkIdentity links a provider's subject to an existing user. The provider
+// verified the email, so the user's email counts as verified if it matches.
+// Whoever registered an unverified account may not own the email, so their
+// password, second factor, sessions and tokens are dropped before linking.
+func LinkIdentity(ctx context.Context, pool *pgxpool.Pool, userID, provider, subject, email string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var verified bool
+	err = tx.QueryRow(ctx, `SELECT email_verified FROM users WHERE user_id = $1 FOR UPDATE`, userID).Scan(&verified)
+	if err == pgx.ErrNoRows {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !verified {
+		if err := dropCredentials(ctx, tx, userID); err != nil {
+			return err
+		}
+	}
+
+	if err := insertIdentity(ctx, tx, userID, provider, subject, email); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE users SET email_verified = TRUE WHERE user_id = $1 AND email = $2`,
+		userID, email,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// dropCredentials signs a user out everywhere and removes every way to sign in
+// other than through a provider.
+func dropCredentials(ctx context.Context, tx pgx.Tx, userID string) error {
+	now := time.Now()
+	batch := &pgx.Batch{}
+	batch.Queue(
+		`UPDATE users SET password_hash = NULL, totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0
+		 WHERE user_id = $1`,
+		userID,
+	)
+	batch.Queue(`DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	batch.Queue(`DELETE FROM password_reset_tokens WHERE user_id = $1`, userID)
+	batch.Queue(`DELETE FROM email_verification_tokens WHERE user_id = $1`, userID)
+	batch.Queue(`UPDATE token_families SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`, userID, now)
+	batch.Queue(`UPDATE personal_access_tokens SET revoked_at = $2 WHERE user_id = $1 AND revoked_at IS NULL`, userID, now)
+
+	br := tx.SendBatch(ctx, batch)
+	for range batch.Len() {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	return br.Close()
+}
+
+// CreateUserWithIdentity creates a user without a password, who signs in through
+// the provider, and links the provider's subject to them.
+func CreateUserWithIdentity(ctx context.Context, pool *pgxpool.Pool, name, email, provider, subject string) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO users (user_name, email, password_hash, email_verified, created_at)
+		 VALUES ($1, $2, NULL, TRUE, $3)
+		 RETURNING user_id`,
+		name, email, time.Now(),
+	).Scan(&userID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := insertIdentity(ctx, tx, userID, provider, subject, email); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+	return userID, nil
+}
+
+func insertIdentity(ctx context.Context, tx pgx.Tx, userID, provider, subject, email string) error {
+	_, err := tx.Exec(
+		ctx,
+		`INSERT INTO user_identities (provider, subject, user_id, email, created_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		provider, subject, userID, email, time.Now(),
+	)
+	return err
+}
@@ -0,0 +1,276 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrInviteNotFound = errors.New("invite not found")
+	ErrInvalidInvite  = errors.New("invalid, expired or used up invite")
+	ErrAlreadyMember  = errors.New("already a member of the group")
+)
+
+// CreateGroupInvite stores an invite link for the group and returns its ID.
+func CreateGroupInvite(ctx context.Context, pool *pgxpool.Pool, invite models.GroupInvite, tokenHash string) (string, error) {
+	var expiresAt *time.Time
+	if invite.ExpiresAt != nil {
+		t := time.Unix(*invite.ExpiresAt, 0)
+		expiresAt = &t
+	}
+
+	var inviteID string
+	err := pool.QueryRow(
+		ctx,
+		`INSERT INTO group_invites (group_id, created_by, token_hash, max_uses, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)
+		 RETURNING invite_id`,
+		invite.GroupID, invite.CreatedBy, tokenHash, invite.MaxUses, time.Now(), expiresAt,
+	).Scan(&inviteID)
+	if err != nil {
+		return "", err
+	}
+	return inviteID, nil
+}
+
+// GroupInvites lists the group's invites that can still be used.
+func GroupInvites(ctx context.Context, pool *pgxpool.Pool, groupID string) ([]models.GroupInvite, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT invite_id, group_id, created_by, max_uses, uses, extract(epoch from created_at)::bigint,
+			extract(epoch from expires_at)::bigint
+		FROM group_invites
+		WHERE group_id = $1 AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > now())
+		AND (max_uses IS NULL OR uses < max_uses)
+		ORDER BY created_at DESC
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []models.GroupInvite{}
+	for rows.Next() {
+		var i models.GroupInvite
+		err := rows.Scan(&i.InviteID, &i.GroupID, &i.CreatedBy, &i.MaxUses, &i.Uses, &i.CreatedAt, &i.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// RevokeGroupInvite revokes one of the group's invites.
+func RevokeGroupInvite(ctx context.Context, pool *pgxpool.Pool, groupID, inviteID string) error {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE group_invites SET revoked_at = $3
+		 WHERE invite_id = $1 AND group_id = $2 AND revoked_at IS NULL`,
+		inviteID, groupID, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// JoinGroupWithInvite adds the user to the group of an invite and counts the use.
+// Members who open the link again don't use it up. Returns the group ID.
+func JoinGroupWithInvite(ctx context.Context, pool *pgxpool.Pool, tokenHash, userID string) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var inviteID, groupID string
+	err = tx.QueryRow(
+		ctx,
+		`SELECT invite_id, group_id FROM group_invites
+		 WHERE token_hash = $1 AND revoked_at IS NULL
+		 AND (expires_at IS NULL OR expires_at > now())
+		 AND (max_uses IS NULL OR uses < max_uses)
+		 FOR UPDATE`,
+		tokenHash,
+	).Scan(&inviteID, &groupID)
+	if err == pgx.ErrNoRows {
+		return "", ErrInvalidInvite
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cmd, err := tx.Exec(
+		ctx,
+		`INSERT INTO group_members (user_id, group_id, joined_at) VALUES ($1, $2, $3)
+		 `+rejoinOnConflict,
+		userID, groupID, time.Now(),
+	)
+	if err != nil {
+		return "", err
+	}
+	if cmd.RowsAffected() == 0 {
+		return groupID, ErrAlreadyMember
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE group_invites SET uses = uses + 1 WHERE invite_id = $1`, inviteID)
+	if err != nil {
+		return "", err
+	}
+
+	return groupID, tx.Commit(ctx)
+}
+
+// ErrAlreadyInvited is returned when the email already has a pending invite to the group.
+var ErrAlreadyInvited = errors.New("email already invited to the group")
+
+// CreateEmailInvite invites an email to the group. With a placeholder name, a guest
+// joins in the invitee's place so they can be split with right away.
+func CreateEmailInvite(ctx context.Context, pool *pgxpool.Pool, groupID, email, invitedBy, placeholderName string) (models.EmailInvite, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return models.EmailInvite{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	invite := models.EmailInvite{GroupID: groupID, Email: email, InvitedBy: invitedBy}
+	if placeholderName != "" {
+		guest, err := insertGuest(ctx, tx, groupID, placeholderName)
+		if err != nil {
+			return models.EmailInvite{}, err
+		}
+		invite.PlaceholderID = &guest.UserID
+	}
+
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO group_email_invites (group_id, email, invited_by, placeholder_id, created_at)
+		 VALUES ($1, $2, $3, $4, $5)
+		 ON CONFLICT (group_id, email) WHERE accepted_at IS NULL DO NOTHING
+		 RETURNING invite_id, extract(epoch from created_at)::bigint`,
+		groupID, email, invitedBy, invite.PlaceholderID, time.Now(),
+	).Scan(&invite.InviteID, &invite.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return models.EmailInvite{}, ErrAlreadyInvited
+	}
+	if err != nil {
+		return models.EmailInvite{}, err
+	}
+
+	return invite, tx.Commit(ctx)
+}
+
+// PendingEmailInvites lists the group's email invites nobody has accepted yet.
+func PendingEmailInvites(ctx context.Context, pool *pgxpool.Pool, groupID string) ([]models.EmailInvite, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT invite_id, group_id, email, COALESCE(invited_by::text, ''), placeholder_id,
+			extract(epoch from created_at)::bigint
+		FROM group_email_invites
+		WHERE group_id = $1 AND accepted_at IS NULL
+		ORDER BY created_at DESC
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invites := []models.EmailInvite{}
+	for rows.Next() {
+		var i models.EmailInvite
+		err := rows.Scan(&i.InviteID, &i.GroupID, &i.Email, &i.InvitedBy, &i.PlaceholderID, &i.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, i)
+	}
+	return invites, rows.Err()
+}
+
+// CancelEmailInvite withdraws a pending email invite. Its placeholder stays in the
+// group as a guest, since it may already be in splits.
+func CancelEmailInvite(ctx context.Context, pool *pgxpool.Pool, groupID, inviteID string) error {
+	cmd, err := pool.Exec(
+		ctx,
+		`DELETE FROM group_email_invites WHERE invite_id = $1 AND group_id = $2 AND accepted_at IS NULL`,
+		inviteID, groupID,
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// AcceptEmailInvites adds the user to every group its email was invited to,
+// taking over the placeholders standing in for it. Only call it once the user
+// has proven they own the email. Returns the group IDs.
+func AcceptEmailInvites(ctx context.Context, pool *pgxpool.Pool, userID, email string) ([]string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(
+		ctx,
+		`UPDATE group_email_invites SET accepted_at = $2
+		 WHERE email = $1 AND accepted_at IS NULL
+		 RETURNING group_id, COALESCE(placeholder_id::text, '')`,
+		email, time.Now(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	type accepted struct{ groupID, placeholderID string }
+	invites, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (accepted, error) {
+		var a accepted
+		err := row.Scan(&a.groupID, &a.placeholderID)
+		return a, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	groupIDs := make([]string, 0, len(invites))
+	for _, invite := range invites {
+		groupIDs = append(groupIDs, invite.groupID)
+
+		if invite.placeholderID != "" {
+			var isGuest bool
+			err := tx.QueryRow(ctx, `SELECT is_guest FROM users WHERE user_id = $1`, invite.placeholderID).Scan(&isGuest)
+			if err != nil && err != pgx.ErrNoRows {
+				return nil, err
+			}
+			// Placeholders claimed or merged elsewhere in the meantime are gone
+			if isGuest {
+				if err := mergeUsers(ctx, tx, invite.placeholderID, userID); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		_, err := tx.Exec(
+			ctx,
+			`INSERT INTO group_members (user_id, group_id, joined_at) VALUES ($1, $2, $3)
+			 `+rejoinOnConflict,
+			userID, invite.groupID, time.Now(),
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return groupIDs, tx.Commit(ctx)
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"shared-expenses-app/ratelimit"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// loginAttemptPruneInterval is how often keys that are no longer blocked are deleted
+const loginAttemptPruneInterval = 10 * time.Minute
+
+// LoginAttemptStore keeps login throttling state in Postgres, so it survives
+// restarts and is shared between replicas.
+type LoginAttemptStore struct {
+	pool    *pgxpool.Pool
+	keepFor time.Duration
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+// NewLoginAttemptStore returns a store over the login_attempts table. Like the
+// memory store, keys are deleted once they have had no failure for keepFor and
+// are not blocked, so failures for made-up accounts don't pile up.
+func NewLoginAttemptStore(pool *pgxpool.Pool, keepFor time.Duration) *LoginAttemptStore {
+	return &LoginAttemptStore{pool: pool, keepFor: keepFor, lastPruned: time.Now()}
+}
+
+func (s *LoginAttemptStore) Get(ctx context.Context, key string) (ratelimit.Attempts, error) {
+	var attempts ratelimit.Attempts
+	var lastFailure, blockedUntil *time.Time
+	err := s.pool.QueryRow(
+		ctx,
+		`SELECT failures, last_failure, blocked_until FROM login_attempts WHERE attempt_key = $1`,
+		key,
+	).Scan(&attempts.Failures, &lastFailure, &blockedUntil)
+	if err == pgx.ErrNoRows {
+		return ratelimit.Attempts{}, nil
+	}
+	if err != nil {
+		return ratelimit.Attempts{}, err
+	}
+
+	if lastFailure != nil {
+		attempts.LastFailure = *lastFailure
+	}
+	if blockedUntil != nil {
+		attempts.BlockedUntil = *blockedUntil
+	}
+	return attempts, nil
+}
+
+func (s *LoginAttemptStore) Update(ctx context.Context, key string, fn func(ratelimit.Attempts) ratelimit.Attempts) (ratelimit.Attempts, error) {
+	if err := s.prune(ctx); err != nil {
+		return ratelimit.Attempts{}, err
+	}
+
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return ratelimit.Attempts{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Make sure the row exists, so it can be locked
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO login_attempts (attempt_key) VALUES ($1) ON CONFLICT (attempt_key) DO NOTHING`,
+		key,
+	)
+	if err != nil {
+		return ratelimit.Attempts{}, err
+	}
+
+	var attempts ratelimit.Attempts
+	var lastFailure, blockedUntil *time.Time
+	err = tx.QueryRow(
+		ctx,
+		`SELECT failures, last_failure, blocked_until FROM login_attempts WHERE attempt_key = $1 FOR UPDATE`,
+		key,
+	).Scan(&attempts.Failures, &lastFailure, &blockedUntil)
+	if err != nil {
+		return ratelimit.Attempts{}, err
+	}
+	if lastFailure != nil {
+		attempts.LastFailure = *lastFailure
+	}
+	if blockedUntil != nil {
+		attempts.BlockedUntil = *blockedUntil
+	}
+
+	attempts = fn(attempts)
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE login_attempts SET failures = $2, last_failure = $3, blocked_until = $4 WHERE attempt_key = $1`,
+		key, attempts.Failures, attempts.LastFailure, attempts.BlockedUntil,
+	)
+	if err != nil {
+		return ratelimit.Attempts{}, err
+	}
+
+	return attempts, tx.Commit(ctx)
+}
+
+func (s *LoginAttemptStore) Delete(ctx context.Context, key string) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM login_attempts WHERE attempt_key = $1`, key)
+	return err
+}
+
+func (s *LoginAttemptStore) prune(ctx context.Context) error {
+	s.mu.Lock()
+	now := time.Now()
+	if now.Sub(s.lastPruned) < loginAttemptPruneInterval {
+		s.mu.Unlock()
+		return nil
+	}
+	s.lastPruned = now
+	s.mu.Unlock()
+
+	_, err := s.pool.Exec(
+		ctx,
+		`DELETE FROM login_attempts
+		 WHERE (last_failure IS NULL OR last_failure < $1)
+		 AND (blocked_until IS NULL OR blocked_until < $2)`,
+		now.Add(-s.keepFor), now,
+	)
+	return err
+}
+
+// RecordLockout keeps a record of a key being locked out of logging in.
+func RecordLockout(ctx context.Context, pool *pgxpool.Pool, key, ipAddress string, attempts ratelimit.Attempts) error {
+	_, err := pool.Exec(
+		ctx,
+		`INSERT INTO login_lockouts (attempt_key, failures, ip_address, locked_until, created_at)
+		 VALUES ($1, $2, $3, $4, $5)`,
+		key, attempts.Failures, ipAddress, attempts.BlockedUntil, time.Now(),
+	)
+	return err
+}
@@ -0,0 +1,24 @@
+-- EXPENSE CATEGORIES
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS category TEXT NOT NULL DEFAULT '';
+
+-- EXPENSE TEMPLATES
+CREATE TABLE IF NOT EXISTS expense_templates (
+    template_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    group_id UUID REFERENCES groups (group_id) ON DELETE CASCADE,
+    created_by UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    title TEXT NOT NULL,
+    description TEXT,
+    category TEXT NOT NULL DEFAULT '',
+    split_mode TEXT NOT NULL DEFAULT 'exact',
+    amount DOUBLE PRECISION NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+
+-- EXPENSE TEMPLATE SPLITS
+CREATE TABLE IF NOT EXISTS expense_template_splits (
+    template_id UUID REFERENCES expense_templates (template_id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    amount DOUBLE PRECISION NOT NULL DEFAULT 0,
+    is_paid BOOLEAN DEFAULT FALSE,
+    PRIMARY KEY (template_id, user_id, is_paid)
+);
@@ -0,0 +1,15 @@
+-- GROUP SETTINGS
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS require_confirmation BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- EXPENSE STATUS ('pending', 'approved' or 'disputed')
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'approved';
+
+-- EXPENSE CONFIRMATIONS ('pending', 'confirmed' or 'disputed')
+CREATE TABLE IF NOT EXISTS expense_confirmations (
+    expense_id UUID REFERENCES expenses (expense_id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    status TEXT NOT NULL DEFAULT 'pending',
+    reason TEXT,
+    updated_at TIMESTAMPTZ DEFAULT now(),
+    PRIMARY KEY (expense_id, user_id)
+);
@@ -0,0 +1,19 @@
+-- GROUP WEIGHTS (default consumption units of each member)
+CREATE TABLE IF NOT EXISTS group_weights (
+    group_id UUID REFERENCES groups (group_id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    weight DOUBLE PRECISION NOT NULL,
+    updated_at TIMESTAMPTZ DEFAULT now(),
+    PRIMARY KEY (group_id, user_id)
+);
+
+-- EXPENSE SPLIT MODE ('exact' or 'weights')
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS split_mode TEXT NOT NULL DEFAULT 'exact';
+
+-- EXPENSE WEIGHTS (snapshot of the group weights an expense was split with)
+CREATE TABLE IF NOT EXISTS expense_weights (
+    expense_id UUID REFERENCES expenses (expense_id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    weight DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (expense_id, user_id)
+);
@@ -0,0 +1,4 @@
+-- REFUNDS (expenses that give back part or all of an earlier expense)
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS refund_of UUID REFERENCES expenses (expense_id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS expenses_refund_of_idx ON expenses (refund_of);
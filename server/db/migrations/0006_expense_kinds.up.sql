@@ -0,0 +1,4 @@
+-- EXPENSE KIND ('spend', 'transfer', 'income' or 'refund')
+ALTER TABLE expenses ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT 'spend';
+
+UPDATE expenses SET kind = 'refund' WHERE refund_of IS NOT NULL;
@@ -0,0 +1,18 @@
+-- TOKEN FAMILIES (one per login, every refresh token of a login shares it)
+CREATE TABLE IF NOT EXISTS token_families (
+    family_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
+
+-- REFRESH TOKENS (only hashes are stored, each token can be used once)
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    family_id UUID REFERENCES token_families (family_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON refresh_tokens (family_id);
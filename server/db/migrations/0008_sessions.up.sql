@@ -0,0 +1,6 @@
+-- SESSION DETAILS (each token family is one signed-in device)
+ALTER TABLE token_families
+    ADD COLUMN IF NOT EXISTS device_name TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS ip_address TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMPTZ DEFAULT now();
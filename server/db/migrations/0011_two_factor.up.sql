@@ -0,0 +1,14 @@
+-- TOTP TWO-FACTOR AUTHENTICATION (the secret is set on enrolment, enabled once confirmed)
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS totp_secret TEXT,
+    ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+-- RECOVERY CODES (only hashes are stored, each code can be used once)
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    user_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, code_hash)
+);
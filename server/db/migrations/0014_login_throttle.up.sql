@@ -0,0 +1,19 @@
+-- LOGIN ATTEMPTS (failed logins by email or IP, when throttling state is kept in Postgres)
+CREATE TABLE IF NOT EXISTS login_attempts (
+    attempt_key TEXT PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure TIMESTAMPTZ,
+    blocked_until TIMESTAMPTZ
+);
+
+-- LOGIN LOCKOUTS (kept for auditing)
+CREATE TABLE IF NOT EXISTS login_lockouts (
+    lockout_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    attempt_key TEXT NOT NULL,
+    failures INT NOT NULL,
+    ip_address TEXT NOT NULL DEFAULT '',
+    locked_until TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS login_lockouts_created_at_idx ON login_lockouts (created_at);
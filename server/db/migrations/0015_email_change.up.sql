@@ -0,0 +1,3 @@
+-- EMAIL TOKEN PURPOSE (verifying the current email, or confirming a new one)
+ALTER TABLE email_verification_tokens
+    ADD COLUMN IF NOT EXISTS purpose TEXT NOT NULL DEFAULT 'verify';
@@ -0,0 +1,3 @@
+-- DELETED ACCOUNTS (anonymized in place, so their splits keep the ledger balanced)
+ALTER TABLE users
+    ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
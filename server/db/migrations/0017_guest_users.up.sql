@@ -0,0 +1,15 @@
+-- GUEST USERS (name-only placeholders, they have no email or password)
+ALTER TABLE users
+    ALTER COLUMN email DROP NOT NULL;
+
+-- GUEST CLAIM TOKENS (only hashes are stored, each token can be used once)
+CREATE TABLE IF NOT EXISTS guest_claim_tokens (
+    token_hash TEXT PRIMARY KEY,
+    guest_id UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    created_by UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    used_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS guest_claim_tokens_guest_id_idx ON guest_claim_tokens (guest_id);
@@ -0,0 +1,8 @@
+-- USER REDIRECTS (accounts merged into another, so old IDs still resolve)
+CREATE TABLE IF NOT EXISTS user_redirects (
+    user_id UUID PRIMARY KEY,
+    merged_into UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    merged_at TIMESTAMPTZ DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS user_redirects_merged_into_idx ON user_redirects (merged_into);
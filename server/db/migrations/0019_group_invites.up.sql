@@ -0,0 +1,14 @@
+-- GROUP INVITE LINKS (only hashes are stored, NULL max_uses or expires_at means no limit)
+CREATE TABLE IF NOT EXISTS group_invites (
+    invite_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    group_id UUID REFERENCES groups (group_id) ON DELETE CASCADE,
+    created_by UUID REFERENCES users (user_id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    max_uses INT,
+    uses INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    revoked_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS group_invites_group_id_idx ON group_invites (group_id);
@@ -0,0 +1,14 @@
+-- EMAIL INVITES (people invited to a group before they have an account)
+CREATE TABLE IF NOT EXISTS group_email_invites (
+    invite_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    group_id UUID REFERENCES groups (group_id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    invited_by UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    placeholder_id UUID REFERENCES users (user_id) ON DELETE SET NULL, -- guest standing in for the invitee in splits
+    created_at TIMESTAMPTZ DEFAULT now(),
+    accepted_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS group_email_invites_pending_idx
+    ON group_email_invites (group_id, email) WHERE accepted_at IS NULL;
+CREATE INDEX IF NOT EXISTS group_email_invites_email_idx ON group_email_invites (email);
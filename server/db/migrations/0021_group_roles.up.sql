@@ -0,0 +1,18 @@
+-- GROUP ROLES ('owner', 'admin', 'member' or 'viewer'), group creators become owners
+ALTER TABLE group_members
+    ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'member';
+
+UPDATE group_members gm SET role = 'owner'
+FROM groups g
+WHERE g.group_id = gm.group_id AND g.created_by = gm.user_id AND gm.role = 'member';
+
+-- Groups whose creator is gone get their longest-standing registered member as owner
+UPDATE group_members gm SET role = 'owner'
+WHERE (gm.group_id, gm.user_id) IN (
+    SELECT DISTINCT ON (m.group_id) m.group_id, m.user_id
+    FROM group_members m
+    JOIN users u ON u.user_id = m.user_id
+    WHERE NOT u.is_guest AND u.deleted_at IS NULL
+    AND NOT EXISTS (SELECT 1 FROM group_members o WHERE o.group_id = m.group_id AND o.role = 'owner')
+    ORDER BY m.group_id, m.joined_at
+);
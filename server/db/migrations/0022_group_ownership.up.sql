@@ -0,0 +1,16 @@
+-- GROUP HISTORY (who changed what about a group and its members)
+CREATE TABLE IF NOT EXISTS group_events (
+    event_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    group_id UUID REFERENCES groups (group_id) ON DELETE CASCADE,
+    actor_id UUID REFERENCES users (user_id) ON DELETE SET NULL,
+    kind TEXT NOT NULL,
+    user_id UUID REFERENCES users (user_id) ON DELETE SET NULL, -- member the event is about
+    data JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS group_events_group_id_idx ON group_events (group_id, created_at);
+
+-- OWNERSHIP TRANSFERS (offered by the owner, take effect once accepted)
+ALTER TABLE groups
+    ADD COLUMN IF NOT EXISTS pending_owner_id UUID REFERENCES users (user_id) ON DELETE SET NULL;
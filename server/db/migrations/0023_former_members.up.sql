@@ -0,0 +1,3 @@
+-- FORMER MEMBERS (removed members keep their row, so their history and balances stay in the group)
+ALTER TABLE group_members
+    ADD COLUMN IF NOT EXISTS left_at TIMESTAMPTZ;
@@ -0,0 +1,9 @@
+-- DELETED MEMBERS (accounts deleted before they were made former members leave their groups)
+UPDATE group_members gm
+SET left_at = u.deleted_at
+FROM users u
+WHERE u.user_id = gm.user_id AND u.deleted_at IS NOT NULL AND gm.left_at IS NULL;
+
+DELETE FROM group_weights gw
+USING users u
+WHERE u.user_id = gw.user_id AND u.deleted_at IS NOT NULL;
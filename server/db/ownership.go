@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"shared-expenses-app/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	ErrNoOwnershipOffer = errors.New("no ownership transfer offered to user")
+	ErrCannotOwnGroup   = errors.New("guests and deleted accounts cannot own a group")
+)
+
+// OfferOwnership offers the group to one of its registered members. Nothing
+// changes until they accept, and a new offer replaces a pending one.
+func OfferOwnership(ctx context.Context, pool *pgxpool.Pool, groupID, ownerID, userID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var cannotOwn bool
+	err = tx.QueryRow(
+		ctx,
+		`SELECT u.is_guest OR u.deleted_at IS NOT NULL
+		 FROM group_members gm
+		 JOIN users u ON u.user_id = gm.user_id
+		 WHERE gm.group_id = $1 AND gm.user_id = $2 AND gm.left_at IS NULL`,
+		groupID, userID,
+	).Scan(&cannotOwn)
+	if err == pgx.ErrNoRows {
+		return ErrNotMember
+	}
+	if err != nil {
+		return err
+	}
+	if cannotOwn {
+		return ErrCannotOwnGroup
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE groups SET pending_owner_id = $2 WHERE group_id = $1`, groupID, userID)
+	if err != nil {
+		return err
+	}
+	err = recordGroupEvent(ctx, tx, models.GroupEvent{
+		GroupID: groupID,
+		ActorID: &ownerID,
+		Kind:    models.GroupEventOwnershipOffered,
+		UserID:  &userID,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// CancelOwnershipOffer withdraws the pending ownership offer of the group.
+func CancelOwnershipOffer(ctx context.Context, pool *pgxpool.Pool, groupID, ownerID string) error {
+	return closeOwnershipOffer(ctx, pool, groupID, "", ownerID, models.GroupEventOwnershipCancelled)
+}
+
+// DeclineOwnership turns down the ownership the user was offered.
+func DeclineOwnership(ctx context.Context, pool *pgxpool.Pool, groupID, userID string) error {
+	return closeOwnershipOffer(ctx, pool, groupID, userID, userID, models.GroupEventOwnershipDeclined)
+}
+
+// closeOwnershipOffer clears the pending offer, if it was made to offeredTo when given.
+func closeOwnershipOffer(ctx context.Context, pool *pgxpool.Pool, groupID, offeredTo, actorID, kind string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var pendingOwner *string
+	err = tx.QueryRow(ctx, `SELECT pending_owner_id FROM groups WHERE group_id = $1 FOR UPDATE`, groupID).Scan(&pendingOwner)
+	if err == pgx.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if pendingOwner == nil || (offeredTo != "" && *pendingOwner != offeredTo) {
+		return ErrNoOwnershipOffer
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE groups SET pending_owner_id = NULL WHERE group_id = $1`, groupID)
+	if err != nil {
+		return err
+	}
+
+	err = recordGroupEvent(ctx, tx, models.GroupEvent{
+		GroupID: groupID,
+		ActorID: &actorID,
+		Kind:    kind,
+		UserID:  pendingOwner,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// AcceptOwnership makes the user the owner of the group it was offered, and the
+// previous owner an admin.
+func AcceptOwnership(ctx context.Context, pool *pgxpool.Pool, groupID, userID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var pendingOwner *string
+	err = tx.QueryRow(ctx, `SELECT pending_owner_id FROM groups WHERE group_id = $1 FOR UPDATE`, groupID).Scan(&pendingOwner)
+	if err == pgx.ErrNoRows {
+		return ErrGroupNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if pendingOwner == nil || *pendingOwner != userID {
+		return ErrNoOwnershipOffer
+	}
+
+	var previousOwner string
+	err = tx.QueryRow(
+		ctx,
+		`UPDATE group_members SET role = $2 WHERE group_id = $1 AND role = $3 RETURNING user_id`,
+		groupID, models.RoleAdmin, models.RoleOwner,
+	).Scan(&previousOwner)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE group_members SET role = $3 WHERE group_id = $1 AND user_id = $2 AND left_at IS NULL`,
+		groupID, userID, models.RoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrNotMember
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE groups SET pending_owner_id = NULL WHERE group_id = $1`, groupID)
+	if err != nil {
+		return err
+	}
+	err = recordGroupEvent(ctx, tx, models.GroupEvent{
+		GroupID: groupID,
+		ActorID: &userID,
+		Kind:    models.GroupEventOwnershipAccepted,
+		UserID:  &userID,
+		Data:    map[string]string{"previous_owner": previousOwner},
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
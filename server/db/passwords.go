@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrInvalidResetToken is returned for unknown, used or expired password reset tokens.
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// CreatePasswordReset stores a password reset token for the user.
+func CreatePasswordReset(ctx context.Context, pool *pgxpool.Pool, userID, tokenHash string, expiresAt time.Time) error {
+	_, err := pool.Exec(
+		ctx,
+		`INSERT INTO password_reset_tokens (token_hash, user_id, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		tokenHash, userID, time.Now(), expiresAt,
+	)
+	return err
+}
+
+// ResetPassword spends a password reset token and sets the user's new password.
+// Every other reset token of the user is spent too, and all sessions are revoked
+// since whoever held the old password may still be signed in. Returns the user ID.
+func ResetPassword(ctx context.Context, pool *pgxpool.Pool, tokenHash, passwordHash string) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID string
+	err = tx.QueryRow(
+		ctx,
+		`SELECT user_id FROM password_reset_tokens
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > now()
+		 FOR UPDATE`,
+		tokenHash,
+	).Scan(&userID)
+	if err == pgx.ErrNoRows {
+		return "", ErrInvalidResetToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE users SET password_hash = $2 WHERE user_id = $1`, userID, passwordHash)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE password_reset_tokens SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL`,
+		userID, time.Now(),
+	)
+	if err != nil {
+		return "", err
+	}
+	if err := revokeUserSessions(ctx, tx, userID, ""); err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit(ctx)
+}
+
+// ChangePassword sets the user's new password and revokes every other session.
+// Pending reset links are spent, since they were meant for the old password.
+func ChangePassword(ctx context.Context, pool *pgxpool.Pool, userID, passwordHash, keepSessionID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(ctx, `UPDATE users SET password_hash = $2 WHERE user_id = $1`, userID, passwordHash)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE password_reset_tokens SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL`,
+		userID, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := revokeUserSessions(ctx, tx, userID, keepSessionID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
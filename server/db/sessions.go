@@ -0,0 +1,280 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Sentinel errors for refresh token operations
+var (
+	ErrInvalidRefreshToken = errors.New("invalid refresh token")
+	ErrRefreshTokenReused  = errors.New("refresh token reused, session revoked")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+// CreateTokenFamily starts a new token family (one login, shown as a session) for
+// the user and stores its first refresh token. Returns the family ID.
+func CreateTokenFamily(ctx context.Context, pool *pgxpool.Pool, session models.Session, tokenHash string, expiresAt time.Time) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var familyID string
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO token_families (user_id, device_name, ip_address, user_agent, created_at, last_used_at)
+		 VALUES ($1, $2, $3, $4, $5, $5)
+		 RETURNING family_id`,
+		session.UserID, session.DeviceName, session.IPAddress, session.UserAgent, time.Now(),
+	).Scan(&familyID)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO refresh_tokens (token_hash, family_id, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		tokenHash, familyID, time.Now(), expiresAt,
+	)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	return familyID, nil
+}
+
+// RotateRefreshToken spends a refresh token and replaces it with a new one in the
+// same family. Presenting a token that was already spent means it leaked, so the
+// whole family is revoked and ErrRefreshTokenReused is returned.
+// The session's last use is updated from client. Returns the user and family the
+// token belongs to.
+func RotateRefreshToken(ctx context.Context, pool *pgxpool.Pool, oldHash, newHash string, expiresAt time.Time, client models.Session) (string, string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, familyID string
+	var used, revoked bool
+	var tokenExpiresAt time.Time
+	err = tx.QueryRow(
+		ctx,
+		`SELECT f.user_id, f.family_id, rt.used_at IS NOT NULL, f.revoked_at IS NOT NULL, rt.expires_at
+		 FROM refresh_tokens rt
+		 JOIN token_families f ON f.family_id = rt.family_id
+		 WHERE rt.token_hash = $1
+		 FOR UPDATE`,
+		oldHash,
+	).Scan(&userID, &familyID, &used, &revoked, &tokenExpiresAt)
+	if err == pgx.ErrNoRows {
+		return "", "", ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	if revoked {
+		return "", "", ErrRefreshTokenReused
+	}
+	if used {
+		if err := revokeFamily(ctx, tx, familyID); err != nil {
+			return "", "", err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrRefreshTokenReused
+	}
+	if time.Now().After(tokenExpiresAt) {
+		return "", "", ErrInvalidRefreshToken
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE refresh_tokens SET used_at = $2 WHERE token_hash = $1`, oldHash, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`INSERT INTO refresh_tokens (token_hash, family_id, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4)`,
+		newHash, familyID, time.Now(), expiresAt,
+	)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE token_families SET last_used_at = $2, ip_address = $3, user_agent = $4 WHERE family_id = $1`,
+		familyID, time.Now(), client.IPAddress, client.UserAgent,
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", "", err
+	}
+
+	return userID, familyID, nil
+}
+
+// RevokeTokenFamily revokes a token family of the user, ending that login.
+func RevokeTokenFamily(ctx context.Context, pool *pgxpool.Pool, userID, familyID string) error {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE token_families SET revoked_at = $3
+		 WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		familyID, userID, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeTokenFamilyOf revokes the token family a refresh token belongs to.
+func RevokeTokenFamilyOf(ctx context.Context, pool *pgxpool.Pool, tokenHash string) error {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE token_families SET revoked_at = $2
+		 WHERE family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)
+		 AND revoked_at IS NULL`,
+		tokenHash, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrInvalidRefreshToken
+	}
+	return nil
+}
+
+// ActiveSessions lists the user's sessions that are neither revoked nor expired,
+// most recently used first.
+func ActiveSessions(ctx context.Context, pool *pgxpool.Pool, userID string) ([]models.Session, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT f.family_id, f.user_id, f.device_name, f.ip_address, f.user_agent,
+			extract(epoch from f.created_at)::bigint, extract(epoch from f.last_used_at)::bigint
+		FROM token_families f
+		WHERE f.user_id = $1
+		AND f.revoked_at IS NULL
+		AND EXISTS (
+			SELECT 1 FROM refresh_tokens rt
+			WHERE rt.family_id = f.family_id AND rt.used_at IS NULL AND rt.expires_at > now()
+		)
+		ORDER BY f.last_used_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []models.Session{}
+	for rows.Next() {
+		var s models.Session
+		err := rows.Scan(&s.SessionID, &s.UserID, &s.DeviceName, &s.IPAddress, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// SessionStartedAt returns when the user signed in to an active session, which
+// refreshing its tokens doesn't change.
+func SessionStartedAt(ctx context.Context, pool *pgxpool.Pool, userID, familyID string) (time.Time, error) {
+	var createdAt time.Time
+	err := pool.QueryRow(
+		ctx,
+		`SELECT created_at FROM token_families WHERE family_id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		familyID, userID,
+	).Scan(&createdAt)
+	if err == pgx.ErrNoRows {
+		return time.Time{}, ErrSessionNotFound
+	}
+	return createdAt, err
+}
+
+// RevokeOtherSessions revokes every session of the user except keepID.
+// Returns the number of sessions revoked.
+func RevokeOtherSessions(ctx context.Context, pool *pgxpool.Pool, userID, keepID string) (int64, error) {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE token_families SET revoked_at = $3
+		 WHERE user_id = $1 AND family_id <> $2 AND revoked_at IS NULL`,
+		userID, keepID, time.Now(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
+
+// TouchSession reports whether a session is still active and records its use.
+// The last use is only written once a minute to keep reads cheap.
+func TouchSession(ctx context.Context, pool *pgxpool.Pool, familyID string, client models.Session) (bool, error) {
+	var lastUsedAt time.Time
+	err := pool.QueryRow(
+		ctx,
+		`SELECT last_used_at FROM token_families WHERE family_id = $1 AND revoked_at IS NULL`,
+		familyID,
+	).Scan(&lastUsedAt)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if time.Since(lastUsedAt) > time.Minute {
+		_, err = pool.Exec(
+			ctx,
+			`UPDATE token_families SET last_used_at = $2, ip_address = $3, user_agent = $4 WHERE family_id = $1`,
+			familyID, time.Now(), client.IPAddress, client.UserAgent,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func revokeFamily(ctx context.Context, tx pgx.Tx, familyID string) error {
+	_, err := tx.Exec(
+		ctx,
+		`UPDATE token_families SET revoked_at = $2 WHERE family_id = $1 AND revoked_at IS NULL`,
+		familyID, time.Now(),
+	)
+	return err
+}
+
+// revokeUserSessions revokes every session of the user except keepID, which may be empty.
+func revokeUserSessions(ctx context.Context, tx pgx.Tx, userID, keepID string) error {
+	_, err := tx.Exec(
+		ctx,
+		`UPDATE token_families SET revoked_at = $3
+		 WHERE user_id = $1 AND family_id::text <> $2 AND revoked_at IS NULL`,
+		userID, keepID, time.Now(),
+	)
+	return err
+}
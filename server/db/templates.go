@@ -0,0 +1,390 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/models"
+	"shared-expenses-app/utils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrTemplateNotFound is returned when a template does not exist.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// CreateTemplate stores a reusable expense template together with its participants.
+func CreateTemplate(ctx context.Context, pool *pgxpool.Pool, template models.ExpenseTemplate) (string, error) {
+	if template.Title == "" {
+		return "", errors.New("title required")
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var templateID string
+	err = tx.QueryRow(
+		ctx,
+		`INSERT INTO expense_templates (
+			group_id, created_by, title, description, category, split_mode, amount, created_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING template_id`,
+		template.GroupID,
+		template.CreatedBy,
+		template.Title,
+		template.Description,
+		template.Category,
+		template.SplitMode,
+		template.Amount,
+		time.Now(),
+	).Scan(&templateID)
+	if err != nil {
+		return "", err
+	}
+
+	if err := insertTemplateSplits(ctx, tx, templateID, template.Splits); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", err
+	}
+
+	return templateID, nil
+}
+
+// UpdateTemplate replaces the details and participants of an existing template.
+func UpdateTemplate(ctx context.Context, pool *pgxpool.Pool, template models.ExpenseTemplate) error {
+	if template.TemplateID == "" {
+		return errors.New("template_id required")
+	}
+	if template.Title == "" {
+		return errors.New("title required")
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE expense_templates
+			SET title = $2,
+				description = $3,
+				category = $4,
+				split_mode = $5,
+				amount = $6
+			WHERE template_id = $1`,
+		template.TemplateID,
+		template.Title,
+		template.Description,
+		template.Category,
+		template.SplitMode,
+		template.Amount,
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrTemplateNotFound
+	}
+
+	// Remove old participants first
+	_, err = tx.Exec(ctx, `DELETE FROM expense_template_splits WHERE template_id = $1`, template.TemplateID)
+	if err != nil {
+		return err
+	}
+
+	if err := insertTemplateSplits(ctx, tx, template.TemplateID, template.Splits); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func insertTemplateSplits(ctx context.Context, tx pgx.Tx, templateID string, splits []models.ExpenseSplit) error {
+	if len(splits) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, split := range splits {
+		batch.Queue(`
+			INSERT INTO expense_template_splits (template_id, user_id, amount, is_paid)
+			VALUES ($1, $2, $3, $4)
+		`, templateID, split.UserID, split.Amount, split.IsPaid)
+	}
+	br := tx.SendBatch(ctx, batch)
+
+	for range splits {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+
+	return br.Close()
+}
+
+// TemplateGroup returns the group a template belongs to.
+func TemplateGroup(ctx context.Context, pool *pgxpool.Pool, templateID string) (string, error) {
+	var groupID string
+	err := pool.QueryRow(ctx, `SELECT group_id FROM expense_templates WHERE template_id = $1`, templateID).Scan(&groupID)
+	if err == pgx.ErrNoRows {
+		return "", ErrTemplateNotFound
+	}
+	return groupID, err
+}
+
+// TemplateOwner returns the group a template belongs to and the user who created it.
+func TemplateOwner(ctx context.Context, pool *pgxpool.Pool, templateID string) (string, string, error) {
+	var groupID, createdBy string
+	err := pool.QueryRow(ctx, `SELECT group_id, created_by FROM expense_templates WHERE template_id = $1`, templateID).Scan(&groupID, &createdBy)
+	if err == pgx.ErrNoRows {
+		return "", "", ErrTemplateNotFound
+	}
+	return groupID, createdBy, err
+}
+
+// GetTemplate returns a template with its participants.
+func GetTemplate(ctx context.Context, pool *pgxpool.Pool, templateID string) (models.ExpenseTemplate, error) {
+	var template models.ExpenseTemplate
+
+	err := pool.QueryRow(
+		ctx,
+		`SELECT template_id,
+			group_id,
+			created_by,
+			title,
+			description,
+			category,
+			split_mode,
+			amount,
+			extract(epoch from created_at)::bigint
+		 FROM expense_templates
+		 WHERE template_id = $1`,
+		templateID,
+	).Scan(
+		&template.TemplateID,
+		&template.GroupID,
+		&template.CreatedBy,
+		&template.Title,
+		&template.Description,
+		&template.Category,
+		&template.SplitMode,
+		&template.Amount,
+		&template.CreatedAt,
+	)
+	if err == pgx.ErrNoRows {
+		return models.ExpenseTemplate{}, ErrTemplateNotFound
+	}
+	if err != nil {
+		return models.ExpenseTemplate{}, err
+	}
+
+	// Fetch participants
+	rows, err := pool.Query(
+		ctx,
+		`SELECT user_id, amount, is_paid FROM expense_template_splits WHERE template_id = $1`,
+		templateID,
+	)
+	if err != nil {
+		return models.ExpenseTemplate{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var split models.ExpenseSplit
+		if err := rows.Scan(&split.UserID, &split.Amount, &split.IsPaid); err != nil {
+			return models.ExpenseTemplate{}, err
+		}
+		template.Splits = append(template.Splits, split)
+	}
+
+	return template, rows.Err()
+}
+
+// GroupTemplates lists the templates saved in a group, without their participants.
+func GroupTemplates(ctx context.Context, pool *pgxpool.Pool, groupID string) ([]models.ExpenseTemplate, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT template_id, group_id, created_by, title, description, category, split_mode, amount,
+			extract(epoch from created_at)::bigint
+		FROM expense_templates
+		WHERE group_id = $1
+		ORDER BY title
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []models.ExpenseTemplate{}
+	for rows.Next() {
+		var t models.ExpenseTemplate
+		err := rows.Scan(
+			&t.TemplateID, &t.GroupID, &t.CreatedBy, &t.Title, &t.Description,
+			&t.Category, &t.SplitMode, &t.Amount, &t.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// DeleteTemplate removes a template and its participants.
+func DeleteTemplate(ctx context.Context, pool *pgxpool.Pool, templateID string) error {
+	cmd, err := pool.Exec(ctx, `DELETE FROM expense_templates WHERE template_id = $1`, templateID)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
+
+// leaveTemplates takes a departing member out of the group's templates, which
+// the rest of the group keeps using, including those the member created. Their
+// splits go to heir if set, see templateSplitsWithout.
+func leaveTemplates(ctx context.Context, tx pgx.Tx, groupID, userID, heir string) error {
+	rows, err := tx.Query(
+		ctx,
+		`SELECT t.template_id, t.split_mode
+		 FROM expense_templates t
+		 WHERE t.group_id = $1
+		 AND EXISTS (SELECT 1 FROM expense_template_splits ts WHERE ts.template_id = t.template_id AND ts.user_id = $2)`,
+		groupID, userID,
+	)
+	if err != nil {
+		return err
+	}
+	templates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.ExpenseTemplate, error) {
+		var t models.ExpenseTemplate
+		err := row.Scan(&t.TemplateID, &t.SplitMode)
+		return t, err
+	})
+	if err != nil {
+		return err
+	}
+	if len(templates) == 0 {
+		return nil
+	}
+
+	// Whoever is left with a side to themselves: the owner, or the longest-standing
+	// member of a group that has lost its owner
+	var fallback string
+	err = tx.QueryRow(
+		ctx,
+		`SELECT user_id FROM group_members
+		 WHERE group_id = $1 AND left_at IS NULL
+		 ORDER BY role = $2 DESC, role = $3 DESC, joined_at
+		 LIMIT 1`,
+		groupID, models.RoleOwner, models.RoleAdmin,
+	).Scan(&fallback)
+	if err != nil && err != pgx.ErrNoRows {
+		return err
+	}
+
+	for _, t := range templates {
+		rows, err := tx.Query(
+			ctx,
+			`SELECT user_id, amount, is_paid FROM expense_template_splits WHERE template_id = $1 ORDER BY user_id`,
+			t.TemplateID,
+		)
+		if err != nil {
+			return err
+		}
+		splits, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (models.ExpenseSplit, error) {
+			var s models.ExpenseSplit
+			err := row.Scan(&s.UserID, &s.Amount, &s.IsPaid)
+			return s, err
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `DELETE FROM expense_template_splits WHERE template_id = $1`, t.TemplateID)
+		if err != nil {
+			return err
+		}
+		if err := insertTemplateSplits(ctx, tx, t.TemplateID, templateSplitsWithout(splits, t.SplitMode, userID, heir, fallback)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateSplitsWithout returns a template's splits without userID, keeping each
+// side usable and, in exact templates, adding up to what it did. Their splits go
+// to heir when set. Otherwise the rest of their side shares them, in proportion to
+// their amounts in exact templates, and fallback takes them if nobody is left.
+// Without a fallback either, they are dropped.
+func templateSplitsWithout(splits []models.ExpenseSplit, mode, userID, heir, fallback string) []models.ExpenseSplit {
+	var kept, leaving []models.ExpenseSplit
+	for _, s := range splits {
+		if s.UserID == userID {
+			leaving = append(leaving, s)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+
+	for _, l := range leaving {
+		var side []int
+		var sideTotal float64
+		for i, s := range kept {
+			if s.IsPaid == l.IsPaid {
+				side = append(side, i)
+				sideTotal += s.Amount
+			}
+		}
+
+		if heir == "" && len(side) > 0 {
+			if mode != models.SplitModeExact {
+				continue
+			}
+			if sideTotal > 0 {
+				weights := make([]float64, len(side))
+				for j, i := range side {
+					weights[j] = kept[i].Amount
+				}
+				parts, err := utils.SplitByWeights(sideTotal+l.Amount, weights)
+				if err == nil {
+					for j, i := range side {
+						kept[i].Amount = parts[j]
+					}
+					continue
+				}
+			}
+		}
+
+		to := heir
+		if to == "" {
+			to = fallback
+		}
+		if to == "" {
+			continue
+		}
+		merged := false
+		for i := range kept {
+			if kept[i].UserID == to && kept[i].IsPaid == l.IsPaid {
+				kept[i].Amount = utils.RoundCents(kept[i].Amount + l.Amount)
+				merged = true
+			}
+		}
+		if !merged {
+			kept = append(kept, models.ExpenseSplit{UserID: to, Amount: l.Amount, IsPaid: l.IsPaid})
+		}
+	}
+	return kept
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrTokenNotFound is returned for unknown, revoked or expired personal access tokens.
+var ErrTokenNotFound = errors.New("token not found")
+
+// CreatePersonalToken stores a personal access token and returns its ID.
+func CreatePersonalToken(ctx context.Context, pool *pgxpool.Pool, token models.PersonalAccessToken, tokenHash string) (string, error) {
+	var expiresAt *time.Time
+	if token.ExpiresAt != nil {
+		t := time.Unix(*token.ExpiresAt, 0)
+		expiresAt = &t
+	}
+
+	var tokenID string
+	err := pool.QueryRow(
+		ctx,
+		`INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, group_id, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7)
+		 RETURNING token_id`,
+		token.UserID, token.Name, tokenHash, token.Scopes, token.GroupID, time.Now(), expiresAt,
+	).Scan(&tokenID)
+	if err != nil {
+		return "", err
+	}
+	return tokenID, nil
+}
+
+// PersonalTokens lists the user's tokens that are neither revoked nor expired.
+func PersonalTokens(ctx context.Context, pool *pgxpool.Pool, userID string) ([]models.PersonalAccessToken, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT token_id, user_id, name, scopes, group_id, extract(epoch from created_at)::bigint,
+			extract(epoch from expires_at)::bigint, extract(epoch from last_used_at)::bigint
+		FROM personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []models.PersonalAccessToken{}
+	for rows.Next() {
+		var t models.PersonalAccessToken
+		err := rows.Scan(&t.TokenID, &t.UserID, &t.Name, &t.Scopes, &t.GroupID, &t.CreatedAt, &t.ExpiresAt, &t.LastUsedAt)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokePersonalToken revokes one of the user's tokens.
+func RevokePersonalToken(ctx context.Context, pool *pgxpool.Pool, userID, tokenID string) error {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE personal_access_tokens SET revoked_at = $3
+		 WHERE token_id = $1 AND user_id = $2 AND revoked_at IS NULL`,
+		tokenID, userID, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// AuthenticatePersonalToken returns the active token with the given hash and
+// records its use. The last use is only written once a minute, like sessions.
+func AuthenticatePersonalToken(ctx context.Context, pool *pgxpool.Pool, tokenHash string) (models.PersonalAccessToken, error) {
+	var t models.PersonalAccessToken
+	var lastUsedAt *time.Time
+	err := pool.QueryRow(
+		ctx,
+		`SELECT token_id, user_id, name, scopes, group_id, extract(epoch from created_at)::bigint,
+			extract(epoch from expires_at)::bigint, last_used_at
+		 FROM personal_access_tokens
+		 WHERE token_hash = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > now())`,
+		tokenHash,
+	).Scan(&t.TokenID, &t.UserID, &t.Name, &t.Scopes, &t.GroupID, &t.CreatedAt, &t.ExpiresAt, &lastUsedAt)
+	if err == pgx.ErrNoRows {
+		return models.PersonalAccessToken{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return models.PersonalAccessToken{}, err
+	}
+
+	if lastUsedAt == nil || time.Since(*lastUsedAt) > time.Minute {
+		now := time.Now()
+		_, err = pool.Exec(ctx, `UPDATE personal_access_tokens SET last_used_at = $2 WHERE token_id = $1`, t.TokenID, now)
+		if err != nil {
+			return models.PersonalAccessToken{}, err
+		}
+		lastUsedAt = &now
+	}
+	lastUsed := lastUsedAt.Unix()
+	t.LastUsedAt = &lastUsed
+
+	return t, nil
+}
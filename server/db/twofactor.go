@@ -0,0 +1,175 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Sentinel errors for two-factor authentication
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication not enabled")
+	ErrNoTwoFactorSecret   = errors.New("two-factor enrolment not started")
+)
+
+// TOTPState is the two-factor setup of a user. The secret is set from enrolment
+// on, but only checked at login once the user confirmed it and it is enabled.
+type TOTPState struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64 // last time step a code was accepted for, to stop replays
+}
+
+// GetTOTP returns the two-factor setup of a user.
+func GetTOTP(ctx context.Context, pool *pgxpool.Pool, userID string) (TOTPState, error) {
+	var state TOTPState
+	err := pool.QueryRow(
+		ctx,
+		`SELECT COALESCE(totp_secret, ''), totp_enabled, totp_last_step FROM users WHERE user_id = $1`,
+		userID,
+	).Scan(&state.Secret, &state.Enabled, &state.LastStep)
+	if err == pgx.ErrNoRows {
+		return TOTPState{}, ErrUserNotFound
+	}
+	return state, err
+}
+
+// StartTOTPEnrolment stores a new, not yet enabled, TOTP secret for the user.
+func StartTOTPEnrolment(ctx context.Context, pool *pgxpool.Pool, userID, secret string) error {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE users SET totp_secret = $2, totp_last_step = 0 WHERE user_id = $1 AND NOT totp_enabled`,
+		userID, secret,
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication after the user proved their
+// authenticator works with a code for step, and stores their recovery codes.
+func EnableTOTP(ctx context.Context, pool *pgxpool.Pool, userID string, step int64, codeHashes []string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE users SET totp_enabled = TRUE, totp_last_step = $2
+		 WHERE user_id = $1 AND totp_secret IS NOT NULL AND NOT totp_enabled`,
+		userID, step,
+	)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// DisableTOTP turns off two-factor authentication and drops the secret and recovery codes.
+func DisableTOTP(ctx context.Context, pool *pgxpool.Pool, userID string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE user_id = $1`,
+		userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// UseTOTPStep records that a code for step was accepted. Returns false if a code
+// for that step or a later one was already used, so each code works only once.
+func UseTOTPStep(ctx context.Context, pool *pgxpool.Pool, userID string, step int64) (bool, error) {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE users SET totp_last_step = $2 WHERE user_id = $1 AND totp_last_step < $2`,
+		userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() == 1, nil
+}
+
+// UseRecoveryCode spends one of the user's recovery codes. Returns false if the
+// code is unknown or was already used.
+func UseRecoveryCode(ctx context.Context, pool *pgxpool.Pool, userID, codeHash string) (bool, error) {
+	cmd, err := pool.Exec(
+		ctx,
+		`UPDATE recovery_codes SET used_at = $3
+		 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, codeHash, time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	return cmd.RowsAffected() == 1, nil
+}
+
+// ReplaceRecoveryCodes swaps the user's recovery codes for a new set.
+func ReplaceRecoveryCodes(ctx context.Context, pool *pgxpool.Pool, userID string, codeHashes []string) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, codeHashes); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userID string, codeHashes []string) error {
+	_, err := tx.Exec(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	batch := &pgx.Batch{}
+	for _, hash := range codeHashes {
+		batch.Queue(
+			`INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, $3)`,
+			userID, hash, time.Now(),
+		)
+	}
+	br := tx.SendBatch(ctx, batch)
+	for range batch.Len() {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+	return br.Close()
+}
@@ -14,9 +14,10 @@ import (
 
 // Sentinel errors for user-related operations
 var (
-	ErrUserNotFound    = errors.New("user not found")
-	ErrNotMember       = errors.New("not a member")
-	ErrUsersNotRelated = errors.New("users not related")
+	ErrUserNotFound       = errors.New("user not found")
+	ErrEmailNotRegistered = errors.New("email not registered")
+	ErrNotMember          = errors.New("not a member")
+	ErrUsersNotRelated    = errors.New("users not related")
 )
 
 // CreateUser inserts a new user into the database and returns the newly created user's ID.
@@ -26,7 +27,7 @@ func CreateUser(ctx context.Context, pool *pgxpool.Pool, name, email, password s
 	if err == nil {
 		// User already exists
 		return "", errors.New("user with this email already exists")
-	} else if err != nil && err.Error() != "email not registered" {
+	} else if err != nil && !errors.Is(err, ErrEmailNotRegistered) {
 		// Some other database error
 		return "", err
 	}
@@ -52,13 +53,13 @@ func CreateUser(ctx context.Context, pool *pgxpool.Pool, name, email, password s
 func GetUserFromEmail(ctx context.Context, pool *pgxpool.Pool, email string) (models.User, error) {
 	var user models.User
 	err := pool.QueryRow(ctx,
-		`SELECT user_id, user_name, email, is_guest, extract(epoch from created_at)::bigint
+		`SELECT user_id, user_name, email, is_guest, email_verified, deleted_at IS NOT NULL, extract(epoch from created_at)::bigint
 		FROM users
 		WHERE email = $1`,
 		email,
-	).Scan(&user.UserID, &user.Name, &user.Email, &user.Guest, &user.CreatedAt)
+	).Scan(&user.UserID, &user.Name, &user.Email, &user.Guest, &user.Verified, &user.Deleted, &user.CreatedAt)
 	if err == pgx.ErrNoRows {
-		return models.User{}, errors.New("email not registered") // email does not exist
+		return models.User{}, ErrEmailNotRegistered // email does not exist
 	}
 	if err != nil {
 		return models.User{}, err // database error
@@ -67,15 +68,17 @@ func GetUserFromEmail(ctx context.Context, pool *pgxpool.Pool, email string) (mo
 	return user, nil // user exists
 }
 
+// GetUserCredentials returns the user ID and password hash for an email. The hash
+// is empty for accounts that only sign in through an OIDC provider.
 func GetUserCredentials(ctx context.Context, pool *pgxpool.Pool, email string) (string, string, error) {
 	var userID, passwordHash string
 	err := pool.QueryRow(
 		ctx,
-		`SELECT user_id, password_hash FROM users WHERE email = $1`,
+		`SELECT user_id, COALESCE(password_hash, '') FROM users WHERE email = $1`,
 		email,
 	).Scan(&userID, &passwordHash)
 	if err == pgx.ErrNoRows {
-		return "", "", errors.New("email not registered")
+		return "", "", ErrEmailNotRegistered
 	}
 
 	if err != nil {
@@ -89,9 +92,10 @@ func GetUser(ctx context.Context, pool *pgxpool.Pool, userID string) (models.Use
 	var user models.User
 	err := pool.QueryRow(
 		ctx,
-		`SELECT user_id, user_name, email, is_guest, extract(epoch from created_at)::bigint FROM users WHERE user_id = $1`,
+		`SELECT user_id, user_name, email, is_guest, email_verified, deleted_at IS NOT NULL, extract(epoch from created_at)::bigint
+		FROM users WHERE user_id = $1`,
 		userID,
-	).Scan(&user.UserID, &user.Name, &user.Email, &user.Guest, &user.CreatedAt)
+	).Scan(&user.UserID, &user.Name, &user.Email, &user.Guest, &user.Verified, &user.Deleted, &user.CreatedAt)
 	if err == pgx.ErrNoRows {
 		return models.User{}, errors.New("user not found")
 	}
@@ -126,14 +130,16 @@ func UsersRelated(ctx context.Context, pool *pgxpool.Pool, userID1, userID2 stri
 	return nil
 }
 
-// AdminOfGroups return a list of models.Group where the user is the creator
+// AdminOfGroups return a list of models.Group where the user is the owner or an admin
 func AdminOfGroups(ctx context.Context, pool *pgxpool.Pool, userID string) ([]models.Group, error) {
 	rows, err := pool.Query(ctx, `
-		SELECT group_id, group_name, description, created_by, extract(epoch from created_at)::bigint
-		FROM groups
-		WHERE created_by = $1
-		ORDER BY created_at DESC
-	`, userID)
+		SELECT g.group_id, g.group_name, g.description, g.created_by, extract(epoch from g.created_at)::bigint,
+			g.require_confirmation
+		FROM groups g
+		JOIN group_members gm ON gm.group_id = g.group_id
+		WHERE gm.user_id = $1 AND gm.role IN ($2, $3) AND gm.left_at IS NULL
+		ORDER BY g.created_at DESC
+	`, userID, models.RoleOwner, models.RoleAdmin)
 	if err != nil {
 		return nil, err
 	}
@@ -142,7 +148,7 @@ func AdminOfGroups(ctx context.Context, pool *pgxpool.Pool, userID string) ([]mo
 	var groups []models.Group
 	for rows.Next() {
 		var g models.Group
-		err := rows.Scan(&g.GroupID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedAt)
+		err := rows.Scan(&g.GroupID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedAt, &g.RequireConfirmation)
 		if err != nil {
 			return nil, err
 		}
@@ -154,10 +160,11 @@ func AdminOfGroups(ctx context.Context, pool *pgxpool.Pool, userID string) ([]mo
 // MemberOfGroups returns the groups where the user is a member of (includes created groups)
 func MemberOfGroups(ctx context.Context, pool *pgxpool.Pool, userID string) ([]models.Group, error) {
 	rows, err := pool.Query(ctx, `
-		SELECT g.group_id, g.group_name, g.description, g.created_by, extract(epoch from g.created_at)::bigint
+		SELECT g.group_id, g.group_name, g.description, g.created_by, extract(epoch from g.created_at)::bigint,
+			g.require_confirmation
 		FROM groups g
 		JOIN group_members gm ON gm.group_id = g.group_id
-		WHERE gm.user_id = $1
+		WHERE gm.user_id = $1 AND gm.left_at IS NULL
 		ORDER BY g.created_at DESC
 	`, userID)
 	if err != nil {
@@ -168,7 +175,7 @@ func MemberOfGroups(ctx context.Context, pool *pgxpool.Pool, userID string) ([]m
 	var groups []models.Group
 	for rows.Next() {
 		var g models.Group
-		err := rows.Scan(&g.GroupID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedAt)
+		err := rows.Scan(&g.GroupID, &g.Name, &g.Description, &g.CreatedBy, &g.CreatedAt, &g.RequireConfirmation)
 		if err != nil {
 			return nil, err
 		}
@@ -178,11 +185,12 @@ func MemberOfGroups(ctx context.Context, pool *pgxpool.Pool, userID string) ([]m
 }
 
 // UserExists checks if a user with the given userID exists in the database.
+// Deleted accounts don't count.
 // Returns nil if user exists, or ErrUserNotFound if not.
 func UserExists(ctx context.Context, pool *pgxpool.Pool, userID string) error {
 	var exists bool
 	err := pool.QueryRow(ctx,
-		`SELECT true FROM users WHERE user_id = $1`,
+		`SELECT true FROM users WHERE user_id = $1 AND deleted_at IS NULL`,
 		userID,
 	).Scan(&exists)
 	if err == pgx.ErrNoRows {
@@ -200,7 +208,7 @@ func UserExists(ctx context.Context, pool *pgxpool.Pool, userID string) error {
 func MemberOfGroup(ctx context.Context, pool *pgxpool.Pool, userID, groupID string) error {
 	var isMember bool
 	err := pool.QueryRow(ctx,
-		`SELECT true FROM group_members WHERE user_id = $1 AND group_id = $2`,
+		`SELECT true FROM group_members WHERE user_id = $1 AND group_id = $2 AND left_at IS NULL`,
 		userID, groupID,
 	).Scan(&isMember)
 	if err == pgx.ErrNoRows {
@@ -214,8 +222,10 @@ func MemberOfGroup(ctx context.Context, pool *pgxpool.Pool, userID, groupID stri
 }
 
 // AllMembersOfGroup checks if all users in the provided userIDs slice are members of the group.
+// Former members only count for expenseID, when set, if they are already in its splits, so
+// existing expenses can still be edited but nobody adds them to new ones.
 // Returns nil if all users are members, or an error if any user is not a member.
-func AllMembersOfGroup(ctx context.Context, pool *pgxpool.Pool, userIDs []string, groupID string) error {
+func AllMembersOfGroup(ctx context.Context, pool *pgxpool.Pool, userIDs []string, groupID, expenseID string) error {
 	if len(userIDs) == 0 {
 		return nil
 	}
@@ -223,6 +233,34 @@ func AllMembersOfGroup(ctx context.Context, pool *pgxpool.Pool, userIDs []string
 	uniqueUserIDs := utils.GetUniqueUserIDs(userIDs)
 
 	// Query to count how many of the provided userIDs are actually members
+	var count int
+	err := pool.QueryRow(ctx,
+		`SELECT COUNT(DISTINCT gm.user_id)
+		 FROM group_members gm
+		 WHERE gm.group_id = $1 AND gm.user_id = ANY($2)
+		 AND (gm.left_at IS NULL OR EXISTS (
+			SELECT 1 FROM expense_splits es
+			WHERE es.expense_id::text = $3 AND es.user_id = gm.user_id
+		 ))`,
+		groupID, uniqueUserIDs, expenseID,
+	).Scan(&count)
+	if err != nil {
+		return err
+	}
+
+	// If count doesn't match the number of userIDs, some users are not members
+	if count != len(uniqueUserIDs) {
+		return ErrNotMember
+	}
+
+	return nil
+}
+
+// FormerOrCurrentMembers checks that every user is or was a member of the group.
+// Returns nil if so, or ErrNotMember if not.
+func FormerOrCurrentMembers(ctx context.Context, pool *pgxpool.Pool, userIDs []string, groupID string) error {
+	uniqueUserIDs := utils.GetUniqueUserIDs(userIDs)
+
 	var count int
 	err := pool.QueryRow(ctx,
 		`SELECT COUNT(DISTINCT user_id)
@@ -233,11 +271,8 @@ func AllMembersOfGroup(ctx context.Context, pool *pgxpool.Pool, userIDs []string
 	if err != nil {
 		return err
 	}
-
-	// If count doesn't match the number of userIDs, some users are not members
 	if count != len(uniqueUserIDs) {
 		return ErrNotMember
 	}
-
 	return nil
 }
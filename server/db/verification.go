@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/utils"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Sentinel errors for email verification and changes
+var (
+	ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+	ErrEmailTaken               = errors.New("user with this email already exists")
+)
+
+// Purposes of email tokens
+const (
+	emailTokenVerify = "verify" // verify the email the account has
+	emailTokenChange = "change" // confirm a new email before switching to it
+)
+
+// CreateEmailVerification stores a verification token for the given email of the user.
+func CreateEmailVerification(ctx context.Context, pool *pgxpool.Pool, userID, email, tokenHash string, expiresAt time.Time) error {
+	return insertEmailToken(ctx, pool, userID, email, emailTokenVerify, tokenHash, expiresAt)
+}
+
+// CreateEmailChange stores a token confirming the user's new email. Earlier
+// unconfirmed changes are cancelled, only the latest one can be confirmed.
+func CreateEmailChange(ctx context.Context, pool *pgxpool.Pool, userID, newEmail, tokenHash string, expiresAt time.Time) error {
+	_, err := pool.Exec(
+		ctx,
+		`UPDATE email_verification_tokens SET used_at = $3
+		 WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`,
+		userID, emailTokenChange, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	return insertEmailToken(ctx, pool, userID, newEmail, emailTokenChange, tokenHash, expiresAt)
+}
+
+func insertEmailToken(ctx context.Context, pool *pgxpool.Pool, userID, email, purpose, tokenHash string, expiresAt time.Time) error {
+	_, err := pool.Exec(
+		ctx,
+		`INSERT INTO email_verification_tokens (token_hash, user_id, email, purpose, created_at, expires_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		tokenHash, userID, email, purpose, time.Now(), expiresAt,
+	)
+	return err
+}
+
+// VerifyEmail spends a verification token and marks the user's email verified.
+// The token only counts if the user still has the email it was sent to.
+// Returns the user ID.
+func VerifyEmail(ctx context.Context, pool *pgxpool.Pool, tokenHash string) (string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, email string
+	err = tx.QueryRow(
+		ctx,
+		`SELECT user_id, email FROM email_verification_tokens
+		 WHERE token_hash = $1 AND purpose = $2 AND used_at IS NULL AND expires_at > now()
+		 FOR UPDATE`,
+		tokenHash, emailTokenVerify,
+	).Scan(&userID, &email)
+	if err == pgx.ErrNoRows {
+		return "", ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cmd, err := tx.Exec(
+		ctx,
+		`UPDATE users SET email_verified = TRUE WHERE user_id = $1 AND email = $2`,
+		userID, email,
+	)
+	if err != nil {
+		return "", err
+	}
+	if cmd.RowsAffected() == 0 {
+		return "", ErrInvalidVerificationToken
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE email_verification_tokens SET used_at = $3 WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL`,
+		userID, emailTokenVerify, time.Now(),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return userID, tx.Commit(ctx)
+}
+
+// ConfirmEmailChange spends an email change token and switches the user to the
+// new, now verified, email. Every session except keepSessionID is revoked, pass
+// an empty ID to revoke them all. Returns the user ID and their previous email.
+func ConfirmEmailChange(ctx context.Context, pool *pgxpool.Pool, tokenHash, keepSessionID string) (string, string, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var userID, newEmail, oldEmail string
+	err = tx.QueryRow(
+		ctx,
+		`SELECT t.user_id, t.email, u.email
+		 FROM email_verification_tokens t
+		 JOIN users u ON u.user_id = t.user_id
+		 WHERE t.token_hash = $1 AND t.purpose = $2 AND t.used_at IS NULL AND t.expires_at > now()
+		 FOR UPDATE`,
+		tokenHash, emailTokenChange,
+	).Scan(&userID, &newEmail, &oldEmail)
+	if err == pgx.ErrNoRows {
+		return "", "", ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var taken bool
+	err = tx.QueryRow(
+		ctx,
+		`SELECT EXISTS (SELECT 1 FROM users WHERE email = $1 AND user_id <> $2)`,
+		newEmail, userID,
+	).Scan(&taken)
+	if err != nil {
+		return "", "", err
+	}
+	if taken {
+		return "", "", ErrEmailTaken
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE users SET email = $2, email_verified = TRUE WHERE user_id = $1`,
+		userID, newEmail,
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	// Tokens sent to the old address must not verify or change anything anymore
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE email_verification_tokens SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL`,
+		userID, time.Now(),
+	)
+	if err != nil {
+		return "", "", err
+	}
+	_, err = tx.Exec(
+		ctx,
+		`UPDATE password_reset_tokens SET used_at = $2 WHERE user_id = $1 AND used_at IS NULL`,
+		userID, time.Now(),
+	)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := revokeUserSessions(ctx, tx, userID, keepSessionID); err != nil {
+		return "", "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", "", err
+	}
+	return userID, oldEmail, nil
+}
+
+// UnverifiedUsers returns which of the given users have not verified their email.
+// Guests have no email to verify and are never included.
+func UnverifiedUsers(ctx context.Context, pool *pgxpool.Pool, userIDs []string) ([]string, error) {
+	if len(userIDs) == 0 {
+		return []string{}, nil
+	}
+
+	rows, err := pool.Query(
+		ctx,
+		`SELECT user_id FROM users
+		 WHERE user_id = ANY($1) AND NOT email_verified AND NOT is_guest`,
+		utils.GetUniqueUserIDs(userIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	unverified := []string{}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		unverified = append(unverified, userID)
+	}
+	return unverified, rows.Err()
+}
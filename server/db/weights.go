@@ -0,0 +1,123 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"shared-expenses-app/models"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// GroupWeights returns the default weights of the group's members, ordered by user.
+// Members without a weight do not take part in weights splits.
+func GroupWeights(ctx context.Context, pool *pgxpool.Pool, groupID string) ([]models.MemberWeight, error) {
+	rows, err := pool.Query(ctx, `
+		SELECT user_id, weight, extract(epoch from updated_at)::bigint
+		FROM group_weights
+		WHERE group_id = $1
+		ORDER BY user_id
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	weights := []models.MemberWeight{}
+	for rows.Next() {
+		var w models.MemberWeight
+		if err := rows.Scan(&w.UserID, &w.Weight, &w.UpdatedAt); err != nil {
+			return nil, err
+		}
+		weights = append(weights, w)
+	}
+	return weights, rows.Err()
+}
+
+// SetGroupWeights updates the weights of the given members. A weight of zero
+// removes the member from future weights splits.
+func SetGroupWeights(ctx context.Context, pool *pgxpool.Pool, groupID string, weights []models.MemberWeight) error {
+	if len(weights) == 0 {
+		return errors.New("no weights provided")
+	}
+
+	batch := &pgx.Batch{}
+	for _, w := range weights {
+		if w.Weight < 0 {
+			return errors.New("weights cannot be negative")
+		}
+		if w.Weight == 0 {
+			batch.Queue(
+				`DELETE FROM group_weights WHERE group_id = $1 AND user_id = $2`,
+				groupID, w.UserID,
+			)
+			continue
+		}
+		batch.Queue(
+			`INSERT INTO group_weights (group_id, user_id, weight, updated_at)
+			 VALUES ($1, $2, $3, $4)
+			 ON CONFLICT (group_id, user_id)
+			 DO UPDATE SET weight = EXCLUDED.weight, updated_at = EXCLUDED.updated_at`,
+			groupID, w.UserID, w.Weight, time.Now(),
+		)
+	}
+
+	br := pool.SendBatch(ctx, batch)
+	defer br.Close()
+
+	for range weights {
+		if _, err := br.Exec(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func insertExpenseWeights(ctx context.Context, tx pgx.Tx, expenseID string, weights []models.MemberWeight) error {
+	if len(weights) == 0 {
+		return nil
+	}
+
+	batch := &pgx.Batch{}
+	for _, w := range weights {
+		batch.Queue(
+			`INSERT INTO expense_weights (expense_id, user_id, weight) VALUES ($1, $2, $3)`,
+			expenseID, w.UserID, w.Weight,
+		)
+	}
+	br := tx.SendBatch(ctx, batch)
+
+	for range weights {
+		if _, err := br.Exec(); err != nil {
+			br.Close()
+			return err
+		}
+	}
+
+	return br.Close()
+}
+
+func expenseWeights(ctx context.Context, pool *pgxpool.Pool, expenseID string) ([]models.MemberWeight, error) {
+	rows, err := pool.Query(
+		ctx,
+		`SELECT user_id, weight FROM expense_weights WHERE expense_id = $1 ORDER BY user_id`,
+		expenseID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var weights []models.MemberWeight
+	for rows.Next() {
+		var w models.MemberWeight
+		if err := rows.Scan(&w.UserID, &w.Weight); err != nil {
+			return nil, err
+		}
+		weights = append(weights, w)
+	}
+	return weights, rows.Err()
+}
@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogMailer writes emails to a file instead of sending them, for development and tests.
+type LogMailer struct {
+	mu  sync.Mutex
+	out io.Writer // nil writes to the server log
+}
+
+// NewLogMailer appends emails to the file at path, or to the server log if path is empty.
+func NewLogMailer(path string) (*LogMailer, error) {
+	if path == "" {
+		return &LogMailer{}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open mail log: %w", err)
+	}
+	return &LogMailer{out: file}, nil
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	if m.out == nil {
+		log.Printf("[MAILER] To: %s, Subject: %s\n%s", msg.To, msg.Subject, msg.Body)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(m.out, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC1123Z), msg.To, msg.Subject, msg.Body)
+	return err
+}
@@ -0,0 +1,39 @@
+// Package mailer sends the application's emails through a configurable backend.
+package mailer
+
+import (
+	"context"
+	"fmt"
+
+	"shared-expenses-app/utils"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Mailer delivers a single email.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv builds the mailer selected by MAILER: "log" (default) writes emails to
+// the server log or to MAIL_LOG_PATH, "smtp" sends them through SMTP_HOST.
+func FromEnv() (Mailer, error) {
+	switch backend := utils.Getenv("MAILER", "log"); backend {
+	case "log":
+		return NewLogMailer(utils.Getenv("MAIL_LOG_PATH", ""))
+	case "smtp":
+		return NewSMTPMailer(
+			utils.Getenv("SMTP_HOST", ""),
+			utils.Getenv("SMTP_PORT", "587"),
+			utils.Getenv("SMTP_USERNAME", ""),
+			utils.Getenv("SMTP_PASSWORD", ""),
+			utils.Getenv("SMTP_FROM", ""),
+		)
+	default:
+		return nil, fmt.Errorf("invalid MAILER value: %q, must be log or smtp", backend)
+	}
+}
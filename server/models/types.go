@@ -4,12 +4,22 @@ package models
 type User struct {
 	UserID       string  `json:"user_id" db:"user_id"`
 	Name         string  `json:"name" db:"user_name"`
-	Email        string  `json:"email" db:"email"`
-	Guest        bool    `json:"guest" db:"is_guest"`
-	PasswordHash *string `json:"-" db:"password_hash"` // excluded from JSON responses
+	Email        *string `json:"email" db:"email"`    // nil for guests
+	Guest        bool    `json:"guest" db:"is_guest"` // placeholder member without an account until claimed
+	Verified     bool    `json:"email_verified" db:"email_verified"`
+	Deleted      bool    `json:"deleted,omitempty" db:"deleted_at"` // anonymized account, kept for the ledger
+	PasswordHash *string `json:"-" db:"password_hash"`              // excluded from JSON responses
 	CreatedAt    int64   `json:"created_at" db:"created_at"`
 }
 
+// EmailAddress returns the user's email, or "" for guests who have none.
+func (u User) EmailAddress() string {
+	if u.Email == nil {
+		return ""
+	}
+	return *u.Email
+}
+
 type Group struct {
 	GroupID     string `json:"group_id" db:"group_id"`
 	Name        string `json:"name" db:"group_name"`
@@ -17,7 +27,12 @@ type Group struct {
 	CreatedBy   string `json:"created_by" db:"created_by"`
 	CreatedAt   int64  `json:"created_at" db:"created_at"`
 
+	RequireConfirmation bool    `json:"require_confirmation" db:"require_confirmation"` // new expenses stay pending until owers confirm
+	PendingOwner        *string `json:"pending_owner,omitempty" db:"pending_owner_id"`  // member offered ownership, until they accept
+
 	Members []GroupUser `json:"members" db:"-"` // NOTE: Be careful with this, not a part of DB schema
+	// Members who left or were removed, still in the group's expenses and balances
+	FormerMembers []GroupUser `json:"former_members,omitempty" db:"-"`
 }
 
 type GroupMember struct {
@@ -28,27 +43,106 @@ type GroupMember struct {
 
 // GroupUser Not a part of DB schema, used for responses
 type GroupUser struct {
-	UserID   string `json:"user_id"`
-	Name     string `json:"name"`
-	Email    string `json:"email"`
-	Guest    bool   `json:"guest"`
-	JoinedAt int64  `json:"joined_at"`
+	UserID   string  `json:"user_id"`
+	Name     string  `json:"name"`
+	Email    *string `json:"email"`
+	Guest    bool    `json:"guest"`
+	Deleted  bool    `json:"deleted,omitempty"`
+	Role     string  `json:"role"` // see Role*
+	JoinedAt int64   `json:"joined_at"`
+	LeftAt   *int64  `json:"left_at,omitempty"` // set for former members
 }
 
+// Member roles, from most to least trusted. Each group has one owner, admins
+// manage members and settings, members add expenses and viewers only read.
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+	RoleViewer = "viewer"
+)
+
 type Expense struct {
 	ExpenseID          string  `json:"expense_id" db:"expense_id"`
 	GroupID            string  `json:"group_id" db:"group_id"`
 	AddedBy            string  `json:"added_by" db:"added_by"`
 	Title              string  `json:"title" db:"title"`
 	Description        string  `json:"description,omitempty" db:"description"`
+	Category           string  `json:"category,omitempty" db:"category"`
 	CreatedAt          int64   `json:"created_at" db:"created_at"`
 	Amount             float64 `json:"amount" db:"amount"`
 	IsIncompleteAmount bool    `json:"is_incomplete_amount" db:"is_incomplete_amount"`
 	IsIncompleteSplit  bool    `json:"is_incomplete_split" db:"is_incomplete_split"`
 	Latitude           float64 `json:"latitude,omitempty" db:"latitude"`
 	Longitude          float64 `json:"longitude,omitempty" db:"longitude"`
+	Kind               string  `json:"kind" db:"kind"`     // see ExpenseKind*, defaults to spend
+	Status             string  `json:"status" db:"status"` // set by the server, see ExpenseStatus*
+	SplitMode          string  `json:"split_mode,omitempty" db:"split_mode"`
+	RefundOf           *string `json:"refund_of,omitempty" db:"refund_of"` // set on refunds, the expense being refunded
+
+	Splits        []ExpenseSplit        `json:"splits" db:"-"`
+	Confirmations []ExpenseConfirmation `json:"confirmations,omitempty" db:"-"`
+	Weights       []MemberWeight        `json:"weights,omitempty" db:"-"` // group weights used by a weights split
+
+	// Not a part of DB schema, filled in for responses
+	Refunds   []Expense      `json:"refunds,omitempty" db:"-"`
+	NetAmount *float64       `json:"net_amount,omitempty" db:"-"` // amount left after approved refunds
+	NetSplits []ExpenseSplit `json:"net_splits,omitempty" db:"-"` // splits left after approved refunds
+}
+
+// Expense kinds. For spend and transfer the paid splits are who paid the money and
+// the owed splits who it was for. For income and refund the paid splits are who
+// received the money and the owed splits who it belongs to.
+const (
+	ExpenseKindSpend    = "spend"
+	ExpenseKindTransfer = "transfer" // cash handed from one member to another, not group spending
+	ExpenseKindIncome   = "income"   // money the group earns
+	ExpenseKindRefund   = "refund"   // money given back for an earlier expense, see RefundOf
+)
+
+// Expense statuses, only approved expenses count towards balances
+const (
+	ExpenseStatusApproved = "approved"
+	ExpenseStatusPending  = "pending"
+	ExpenseStatusDisputed = "disputed"
+)
 
-	Splits []ExpenseSplit `json:"splits" db:"-"`
+// Confirmation statuses of a single participant
+const (
+	ConfirmationPending   = "pending"
+	ConfirmationConfirmed = "confirmed"
+	ConfirmationDisputed  = "disputed"
+)
+
+type ExpenseConfirmation struct {
+	ExpenseID string `json:"-" db:"expense_id"`
+	UserID    string `json:"user_id" db:"user_id"`
+	Status    string `json:"status" db:"status"`
+	Reason    string `json:"reason,omitempty" db:"reason"`
+	UpdatedAt int64  `json:"updated_at" db:"updated_at"`
+}
+
+// GroupTotals Not a part of DB schema, approved amounts of a group by kind
+type GroupTotals struct {
+	Spending  float64 `json:"spending"` // spend minus refunds
+	Refunds   float64 `json:"refunds"`
+	Transfers float64 `json:"transfers"`
+	Income    float64 `json:"income"`
+}
+
+// Balance Not a part of DB schema, a user's net position within a group
+type Balance struct {
+	UserID string  `json:"user_id"`
+	Paid   float64 `json:"paid"`
+	Owed   float64 `json:"owed"`
+	Net    float64 `json:"net"` // positive when the rest of the group owes the user
+}
+
+// GroupBalance Not a part of DB schema, a user's net position in one of their groups
+type GroupBalance struct {
+	GroupID   string  `json:"group_id"`
+	GroupName string  `json:"group_name"`
+	Net       float64 `json:"net"`
 }
 
 type ExpenseSplit struct {
@@ -57,3 +151,106 @@ type ExpenseSplit struct {
 	Amount    float64 `json:"amount" db:"amount"`
 	IsPaid    bool    `json:"is_paid" db:"is_paid"` // "paid" or "owes"
 }
+
+// Split modes of expenses and expense templates
+const (
+	SplitModeExact   = "exact"   // split amounts as given (templates scale them to the expense amount)
+	SplitModeEqual   = "equal"   // templates only, amount divided evenly among payers and among owers
+	SplitModeWeights = "weights" // owed splits computed by the server from the group's member weights
+)
+
+type MemberWeight struct {
+	UserID    string  `json:"user_id" db:"user_id"`
+	Weight    float64 `json:"weight" db:"weight"`
+	UpdatedAt int64   `json:"updated_at,omitempty" db:"updated_at"`
+}
+
+type ExpenseTemplate struct {
+	TemplateID  string  `json:"template_id" db:"template_id"`
+	GroupID     string  `json:"group_id" db:"group_id"`
+	CreatedBy   string  `json:"created_by" db:"created_by"`
+	Title       string  `json:"title" db:"title"`
+	Description string  `json:"description,omitempty" db:"description"`
+	Category    string  `json:"category,omitempty" db:"category"`
+	SplitMode   string  `json:"split_mode" db:"split_mode"`
+	Amount      float64 `json:"amount" db:"amount"` // default amount for new expenses
+	CreatedAt   int64   `json:"created_at" db:"created_at"`
+
+	Splits []ExpenseSplit `json:"splits" db:"-"` // amounts are ignored in equal mode, owers in weights mode
+}
+
+// Session is a signed-in device, backed by a refresh token family
+type Session struct {
+	SessionID  string `json:"session_id" db:"family_id"`
+	UserID     string `json:"-" db:"user_id"`
+	DeviceName string `json:"device_name,omitempty" db:"device_name"`
+	IPAddress  string `json:"ip_address,omitempty" db:"ip_address"`
+	UserAgent  string `json:"user_agent,omitempty" db:"user_agent"`
+	CreatedAt  int64  `json:"created_at" db:"created_at"`
+	LastUsedAt int64  `json:"last_used_at" db:"last_used_at"`
+	Current    bool   `json:"current" db:"-"` // the session making the request
+}
+
+// PersonalAccessToken lets scripts call the API as a user, limited to its scopes
+// and optionally to one group. The token itself is only shown once, on creation.
+type PersonalAccessToken struct {
+	TokenID    string   `json:"token_id" db:"token_id"`
+	UserID     string   `json:"-" db:"user_id"`
+	Name       string   `json:"name" db:"name"`
+	Scopes     []string `json:"scopes" db:"scopes"`
+	GroupID    *string  `json:"group_id,omitempty" db:"group_id"` // nil allows every group of the user
+	CreatedAt  int64    `json:"created_at" db:"created_at"`
+	ExpiresAt  *int64   `json:"expires_at,omitempty" db:"expires_at"` // nil never expires
+	LastUsedAt *int64   `json:"last_used_at,omitempty" db:"last_used_at"`
+}
+
+const (
+	ScopeRead          = "read"           // every GET request
+	ScopeExpensesWrite = "expenses:write" // create and change expenses and templates
+	ScopeGroupsWrite   = "groups:write"   // create and change groups and their settings
+)
+
+// GroupInvite is a shareable link to join a group. The token itself is only
+// shown once, on creation.
+type GroupInvite struct {
+	InviteID  string `json:"invite_id" db:"invite_id"`
+	GroupID   string `json:"group_id" db:"group_id"`
+	CreatedBy string `json:"created_by" db:"created_by"`
+	MaxUses   *int   `json:"max_uses,omitempty" db:"max_uses"` // nil allows any number of joins
+	Uses      int    `json:"uses" db:"uses"`
+	CreatedAt int64  `json:"created_at" db:"created_at"`
+	ExpiresAt *int64 `json:"expires_at,omitempty" db:"expires_at"` // nil never expires
+}
+
+// EmailInvite invites someone without an account to a group. They join when they
+// register with, or verify, that email.
+type EmailInvite struct {
+	InviteID      string  `json:"invite_id" db:"invite_id"`
+	GroupID       string  `json:"group_id" db:"group_id"`
+	Email         string  `json:"email" db:"email"`
+	InvitedBy     string  `json:"invited_by" db:"invited_by"`
+	PlaceholderID *string `json:"placeholder_id,omitempty" db:"placeholder_id"` // guest used in splits until they join
+	CreatedAt     int64   `json:"created_at" db:"created_at"`
+}
+
+// GroupEvent is an entry in a group's history.
+type GroupEvent struct {
+	EventID   string            `json:"event_id" db:"event_id"`
+	GroupID   string            `json:"group_id" db:"group_id"`
+	ActorID   *string           `json:"actor_id,omitempty" db:"actor_id"` // nil once the actor's account is gone
+	Kind      string            `json:"kind" db:"kind"`                   // see GroupEvent*
+	UserID    *string           `json:"user_id,omitempty" db:"user_id"`   // member the event is about
+	Data      map[string]string `json:"data,omitempty" db:"data"`
+	CreatedAt int64             `json:"created_at" db:"created_at"`
+}
+
+// Group event kinds
+const (
+	GroupEventRoleChanged        = "role_changed"        // data: from, to
+	GroupEventOwnershipOffered   = "ownership_offered"   // user is the member offered ownership
+	GroupEventOwnershipCancelled = "ownership_cancelled" // the owner withdrew the offer
+	GroupEventOwnershipDeclined  = "ownership_declined"
+	GroupEventOwnershipAccepted  = "ownership_accepted" // user is the new owner, data: previous_owner
+	GroupEventMemberRemoved      = "member_removed"     // data: reassigned_to and transfer_id, if anything was taken over
+	GroupEventMemberLeft         = "member_left"
+)
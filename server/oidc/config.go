@@ -0,0 +1,42 @@
+package oidc
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"shared-expenses-app/utils"
+)
+
+// Providers are the configured providers by name.
+type Providers map[string]*Provider
+
+// FromEnv reads the providers named in OIDC_PROVIDERS (comma separated). Each
+// provider NAME is configured with OIDC_NAME_ISSUER, OIDC_NAME_CLIENT_ID,
+// OIDC_NAME_CLIENT_SECRET, OIDC_NAME_REDIRECT_URL and optionally OIDC_NAME_SCOPES.
+func FromEnv() (Providers, error) {
+	providers := Providers{}
+	for name := range strings.SplitSeq(utils.Getenv("OIDC_PROVIDERS", ""), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		config := Config{
+			Name:         name,
+			Issuer:       utils.Getenv(prefix+"ISSUER", ""),
+			ClientID:     utils.Getenv(prefix+"CLIENT_ID", ""),
+			ClientSecret: utils.Getenv(prefix+"CLIENT_SECRET", ""),
+			RedirectURL:  utils.Getenv(prefix+"REDIRECT_URL", ""),
+			Scopes:       strings.Fields(utils.Getenv(prefix+"SCOPES", "")),
+		}
+		if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+			return nil, fmt.Errorf("OIDC provider %q needs %sISSUER, %sCLIENT_ID and %sREDIRECT_URL", name, prefix, prefix, prefix)
+		}
+
+		providers[name] = NewProvider(config, &http.Client{Timeout: 10 * time.Second})
+	}
+	return providers, nil
+}
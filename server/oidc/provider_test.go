@@ -0,0 +1,214 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testIssuer is a minimal OpenID Connect issuer. It hands out idToken for
+// code, as long as the PKCE verifier matches the challenge of the last login.
+// Its discovery document claims to be from claimedIssuer if set.
+type testIssuer struct {
+	*httptest.Server
+	key           *rsa.PrivateKey
+	code          string
+	challenge     string
+	idToken       string
+	claimedIssuer string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &testIssuer{key: key, code: "the-code"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		claimed := issuer.claimedIssuer
+		if claimed == "" {
+			claimed = issuer.URL
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 claimed,
+			"authorization_endpoint": issuer.URL + "/authorize",
+			"token_endpoint":         issuer.URL + "/token",
+			"jwks_uri":               issuer.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "k1",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, secret, _ := r.BasicAuth()
+		if clientID != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if r.FormValue("grant_type") != "authorization_code" || r.FormValue("code") != issuer.code ||
+			codeChallenge(r.FormValue("code_verifier")) != issuer.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": issuer.idToken})
+	})
+
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+func (i *testIssuer) provider() *Provider {
+	return NewProvider(Config{
+		Name:         "test",
+		Issuer:       i.URL + "/",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://app.example/callback",
+	}, i.Client())
+}
+
+// sign returns an ID token with the given claims, signed with the issuer's key
+// unless another key is given.
+func (i *testIssuer) sign(t *testing.T, claims jwt.MapClaims, key *rsa.PrivateKey) string {
+	t.Helper()
+	if key == nil {
+		key = i.key
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "k1"
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func (i *testIssuer) claims(nonce string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            i.URL,
+		"aud":            "client",
+		"sub":            "subject-1",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          nonce,
+		"email":          "ann@example.com",
+		"email_verified": "true",
+		"name":           "Ann",
+	}
+}
+
+func TestProviderLogin(t *testing.T) {
+	ctx := context.Background()
+	issuer := newTestIssuer(t)
+	provider := issuer.provider()
+
+	authURL, err := provider.AuthURL(ctx, "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := u.Query()
+	if !strings.HasPrefix(authURL, issuer.URL+"/authorize?") || params.Get("client_id") != "client" ||
+		params.Get("state") != "the-state" || params.Get("nonce") != "the-nonce" ||
+		params.Get("code_challenge_method") != "S256" {
+		t.Fatalf("AuthURL() = %s", authURL)
+	}
+	issuer.challenge = params.Get("code_challenge")
+	issuer.idToken = issuer.sign(t, issuer.claims("the-nonce"), nil)
+
+	if _, err := provider.Exchange(ctx, issuer.code, "another-verifier"); err == nil {
+		t.Fatal("Exchange() with the wrong verifier succeeded")
+	}
+	rawToken, err := provider.Exchange(ctx, issuer.code, "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := provider.VerifyIDToken(ctx, rawToken, "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{Subject: "subject-1", Email: "ann@example.com", EmailVerified: true, Name: "Ann"}
+	if claims != want {
+		t.Errorf("VerifyIDToken() = %+v, want %+v", claims, want)
+	}
+}
+
+func TestVerifyIDTokenRejects(t *testing.T) {
+	ctx := context.Background()
+	issuer := newTestIssuer(t)
+	provider := issuer.provider()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		edit  func(jwt.MapClaims)
+		key   *rsa.PrivateKey
+		nonce string
+	}{
+		{name: "nonce mismatch", nonce: "another-nonce"},
+		{name: "missing nonce", edit: func(c jwt.MapClaims) { delete(c, "nonce") }},
+		{name: "other issuer", edit: func(c jwt.MapClaims) { c["iss"] = "https://evil.example" }},
+		{name: "other audience", edit: func(c jwt.MapClaims) { c["aud"] = "another-client" }},
+		{name: "expired", edit: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{name: "no expiry", edit: func(c jwt.MapClaims) { delete(c, "exp") }},
+		{name: "no subject", edit: func(c jwt.MapClaims) { delete(c, "sub") }},
+		{name: "signed by another key", key: otherKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := issuer.claims("the-nonce")
+			if tt.edit != nil {
+				tt.edit(claims)
+			}
+			nonce := tt.nonce
+			if nonce == "" {
+				nonce = "the-nonce"
+			}
+
+			if _, err := provider.VerifyIDToken(ctx, issuer.sign(t, claims, tt.key), nonce); err == nil {
+				t.Error("VerifyIDToken() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	issuer := newTestIssuer(t)
+	issuer.claimedIssuer = "https://evil.example"
+
+	_, err := issuer.provider().AuthURL(context.Background(), "s", "n", "v")
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("AuthURL() = %v, want an issuer mismatch", err)
+	}
+}
@@ -0,0 +1,150 @@
+// Package policy decides who may act on a group and the expenses and templates in it.
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"shared-expenses-app/models"
+)
+
+var (
+	// ErrDenied is wrapped by the errors Check and CheckRoleChange return.
+	ErrDenied = errors.New("access denied")
+
+	// ErrInvalidRole is returned for roles other than the Role* constants.
+	ErrInvalidRole = errors.New("invalid role")
+)
+
+// Subject is a user's relation to a group, and to the resource in it that a request is about.
+type Subject struct {
+	UserID  string
+	GroupID string
+	Role    string // role in the group, empty for non-members
+	AddedBy string // user who added the expense or created the template, if any
+}
+
+// Rule allows or denies a subject. Rules are combined with AnyOf.
+type Rule struct {
+	who   []string // who the rule allows, for error messages
+	allow func(Subject) bool
+}
+
+var (
+	// Member allows everyone in the group, viewers included.
+	Member = Rule{who: []string{"group members"}, allow: func(s Subject) bool {
+		return s.Role != ""
+	}}
+
+	// Contributor allows members who can add expenses, everyone but viewers.
+	Contributor = atLeast(models.RoleMember, "group members who aren't viewers")
+
+	// Admin allows the group's admins and its owner.
+	Admin = atLeast(models.RoleAdmin, "group admins")
+
+	// Owner allows the group's owner.
+	Owner = atLeast(models.RoleOwner, "the group owner")
+
+	// Adder allows the user who added the expense or created the template, as
+	// long as they can still add expenses to the group.
+	Adder = Rule{who: []string{"whoever added it"}, allow: func(s Subject) bool {
+		return s.UserID != "" && s.UserID == s.AddedBy && Contributor.allow(s)
+	}}
+)
+
+func atLeast(role, who string) Rule {
+	return Rule{who: []string{who}, allow: func(s Subject) bool {
+		return s.Role != "" && Rank(s.Role) >= Rank(role)
+	}}
+}
+
+// AnyOf allows subjects allowed by at least one of rules.
+func AnyOf(rules ...Rule) Rule {
+	var who []string
+	for _, rule := range rules {
+		who = append(who, rule.who...)
+	}
+	return Rule{who: who, allow: func(s Subject) bool {
+		for _, rule := range rules {
+			if rule.allow(s) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// Allows reports whether the rule allows the subject.
+func (r Rule) Allows(s Subject) bool {
+	return r.allow != nil && r.allow(s)
+}
+
+// Check returns an error wrapping ErrDenied if the rule does not allow the subject.
+func (r Rule) Check(s Subject) error {
+	if r.Allows(s) {
+		return nil
+	}
+	return &DeniedError{who: r.who}
+}
+
+// DeniedError tells who the rule would have allowed.
+type DeniedError struct {
+	who []string
+}
+
+func (e *DeniedError) Error() string {
+	if len(e.who) == 0 {
+		return ErrDenied.Error()
+	}
+	return "only " + strings.Join(e.who, " or ") + " can do this"
+}
+
+func (e *DeniedError) Unwrap() error {
+	return ErrDenied
+}
+
+// Rank orders roles by trust, higher is more trusted. Unknown roles rank 0.
+func Rank(role string) int {
+	switch role {
+	case models.RoleOwner:
+		return 4
+	case models.RoleAdmin:
+		return 3
+	case models.RoleMember:
+		return 2
+	case models.RoleViewer:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ValidRole reports whether role is one of the member roles.
+func ValidRole(role string) bool {
+	return Rank(role) > 0
+}
+
+// CanManage reports whether an admin with actorRole may remove or change the
+// role of a member with targetRole. Admins manage those below them, so only the
+// owner manages admins and nobody manages the owner.
+func CanManage(actorRole, targetRole string) bool {
+	return Rank(actorRole) >= Rank(models.RoleAdmin) && Rank(actorRole) > Rank(targetRole)
+}
+
+// CheckRoleChange returns an error wrapping ErrDenied unless actorRole may change
+// a member from targetRole to newRole, or ErrInvalidRole for unknown roles.
+// Ownership is never handed out this way.
+func CheckRoleChange(actorRole, targetRole, newRole string) error {
+	switch {
+	case !ValidRole(newRole):
+		return ErrInvalidRole
+	case newRole == models.RoleOwner:
+		return fmt.Errorf("%w: ownership can only be transferred by the owner", ErrDenied)
+	case !CanManage(actorRole, targetRole):
+		return fmt.Errorf("%w: only members above them can change their role", ErrDenied)
+	case Rank(actorRole) <= Rank(newRole):
+		return fmt.Errorf("%w: only members above a role can give it out", ErrDenied)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package policy
+
+import (
+	"errors"
+	"testing"
+
+	"shared-expenses-app/models"
+)
+
+func TestRules(t *testing.T) {
+	owner := Subject{UserID: "u1", GroupID: "g1", Role: models.RoleOwner, AddedBy: "u3"}
+	admin := Subject{UserID: "u2", GroupID: "g1", Role: models.RoleAdmin, AddedBy: "u3"}
+	adder := Subject{UserID: "u3", GroupID: "g1", Role: models.RoleMember, AddedBy: "u3"}
+	member := Subject{UserID: "u4", GroupID: "g1", Role: models.RoleMember, AddedBy: "u3"}
+	viewer := Subject{UserID: "u5", GroupID: "g1", Role: models.RoleViewer, AddedBy: "u3"}
+	outsider := Subject{UserID: "u6", GroupID: "g1", AddedBy: "u3"}
+	viewerAdder := Subject{UserID: "u3", GroupID: "g1", Role: models.RoleViewer, AddedBy: "u3"}
+	formerAdder := Subject{UserID: "u3", GroupID: "g1", AddedBy: "u3"}
+	anonymous := Subject{GroupID: "g1"}
+
+	tests := []struct {
+		name    string
+		rule    Rule
+		subject Subject
+		allowed bool
+	}{
+		{"owner is member", Member, owner, true},
+		{"viewer is member", Member, viewer, true},
+		{"outsider is not member", Member, outsider, false},
+		{"member contributes", Contributor, member, true},
+		{"admin contributes", Contributor, admin, true},
+		{"viewer does not contribute", Contributor, viewer, false},
+		{"outsider does not contribute", Contributor, outsider, false},
+		{"owner is admin", Admin, owner, true},
+		{"admin is admin", Admin, admin, true},
+		{"member is not admin", Admin, member, false},
+		{"owner is owner", Owner, owner, true},
+		{"admin is not owner", Owner, admin, false},
+		{"adder is adder", Adder, adder, true},
+		{"other member is not adder", Adder, member, false},
+		{"adder demoted to viewer is not adder", Adder, viewerAdder, false},
+		{"former member is not adder", Adder, formerAdder, false},
+		{"anonymous is nothing", AnyOf(Member, Adder), anonymous, false},
+		{"unknown role is member only", Admin, Subject{UserID: "u7", Role: "superuser"}, false},
+		{"adder or admin allows adder", AnyOf(Adder, Admin), adder, true},
+		{"adder or admin allows admin", AnyOf(Adder, Admin), admin, true},
+		{"adder or admin denies member", AnyOf(Adder, Admin), member, false},
+		{"empty AnyOf denies", AnyOf(), owner, false},
+		{"zero rule denies", Rule{}, owner, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Allows(tt.subject); got != tt.allowed {
+				t.Errorf("Allows() = %v, want %v", got, tt.allowed)
+			}
+			err := tt.rule.Check(tt.subject)
+			if tt.allowed && err != nil {
+				t.Errorf("Check() = %v, want nil", err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrDenied) {
+				t.Errorf("Check() = %v, want ErrDenied", err)
+			}
+		})
+	}
+}
+
+func TestDeniedMessage(t *testing.T) {
+	err := AnyOf(Adder, Admin).Check(Subject{UserID: "u1"})
+	want := "only whoever added it or group admins can do this"
+	if err == nil || err.Error() != want {
+		t.Errorf("Check() = %v, want %q", err, want)
+	}
+
+	if err := (Rule{}).Check(Subject{}); err == nil || err.Error() != ErrDenied.Error() {
+		t.Errorf("Check() = %v, want %q", err, ErrDenied)
+	}
+}
+
+func TestCanManage(t *testing.T) {
+	tests := []struct {
+		actor, target string
+		want          bool
+	}{
+		{models.RoleOwner, models.RoleAdmin, true},
+		{models.RoleOwner, models.RoleViewer, true},
+		{models.RoleAdmin, models.RoleMember, true},
+		{models.RoleAdmin, models.RoleViewer, true},
+		{models.RoleAdmin, models.RoleAdmin, false},
+		{models.RoleAdmin, models.RoleOwner, false},
+		{models.RoleMember, models.RoleViewer, false},
+		{models.RoleOwner, models.RoleOwner, false},
+		{"", models.RoleViewer, false},
+	}
+	for _, tt := range tests {
+		if got := CanManage(tt.actor, tt.target); got != tt.want {
+			t.Errorf("CanManage(%q, %q) = %v, want %v", tt.actor, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRoleChange(t *testing.T) {
+	tests := []struct {
+		name                  string
+		actor, target, role   string
+		wantDenied, wantValid bool
+	}{
+		{"owner promotes member to admin", models.RoleOwner, models.RoleMember, models.RoleAdmin, false, true},
+		{"owner demotes admin to viewer", models.RoleOwner, models.RoleAdmin, models.RoleViewer, false, true},
+		{"admin demotes member to viewer", models.RoleAdmin, models.RoleMember, models.RoleViewer, false, true},
+		{"admin promotes viewer to member", models.RoleAdmin, models.RoleViewer, models.RoleMember, false, true},
+		{"admin cannot make admins", models.RoleAdmin, models.RoleMember, models.RoleAdmin, true, true},
+		{"admin cannot demote admins", models.RoleAdmin, models.RoleAdmin, models.RoleMember, true, true},
+		{"admin cannot demote the owner", models.RoleAdmin, models.RoleOwner, models.RoleMember, true, true},
+		{"member cannot change roles", models.RoleMember, models.RoleViewer, models.RoleViewer, true, true},
+		{"owner cannot hand out ownership", models.RoleOwner, models.RoleAdmin, models.RoleOwner, true, true},
+		{"unknown role", models.RoleOwner, models.RoleMember, "superuser", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRoleChange(tt.actor, tt.target, tt.role)
+			if got := errors.Is(err, ErrDenied); got != tt.wantDenied {
+				t.Errorf("CheckRoleChange() = %v, denied %v, want %v", err, got, tt.wantDenied)
+			}
+			if got := !errors.Is(err, ErrInvalidRole); got != tt.wantValid {
+				t.Errorf("CheckRoleChange() = %v, valid %v, want %v", err, got, tt.wantValid)
+			}
+			if !tt.wantDenied && tt.wantValid && err != nil {
+				t.Errorf("CheckRoleChange() = %v, want nil", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often the memory store drops keys that are no longer blocked
+const pruneInterval = 10 * time.Minute
+
+// MemoryStore keeps attempts in process memory. It is lost on restart and not
+// shared between replicas, use a database store for those.
+type MemoryStore struct {
+	mu         sync.Mutex
+	attempts   map[string]Attempts
+	keepFor    time.Duration
+	lastPruned time.Time
+}
+
+// NewMemoryStore returns an empty store. Keys are forgotten once they have had no
+// failure for keepFor and are not blocked.
+func NewMemoryStore(keepFor time.Duration) *MemoryStore {
+	return &MemoryStore{attempts: map[string]Attempts{}, keepFor: keepFor, lastPruned: time.Now()}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.attempts[key], nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, key string, fn func(Attempts) Attempts) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune()
+	attempts := fn(s.attempts[key])
+	s.attempts[key] = attempts
+	return attempts, nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.attempts, key)
+	return nil
+}
+
+func (s *MemoryStore) prune() {
+	now := time.Now()
+	if now.Sub(s.lastPruned) < pruneInterval {
+		return
+	}
+	s.lastPruned = now
+
+	for key, a := range s.attempts {
+		if now.Sub(a.LastFailure) > s.keepFor && now.After(a.BlockedUntil) {
+			delete(s.attempts, key)
+		}
+	}
+}
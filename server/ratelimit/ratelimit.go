@@ -0,0 +1,110 @@
+// Package ratelimit slows down repeated failures, such as wrong passwords, with
+// exponential back-off and temporary lockouts.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Attempts is the failure record of one key, such as an email or an IP address.
+type Attempts struct {
+	Failures     int
+	LastFailure  time.Time
+	BlockedUntil time.Time
+}
+
+// Store keeps attempts by key. Update must apply fn atomically, so concurrent
+// failures are all counted.
+type Store interface {
+	Get(ctx context.Context, key string) (Attempts, error)
+	Update(ctx context.Context, key string, fn func(Attempts) Attempts) (Attempts, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// Policy decides how long a key is blocked after a number of failures.
+type Policy struct {
+	FreeFailures    int           // failures allowed before any delay
+	BaseDelay       time.Duration // delay after the first failure past the free ones, doubled for each one after
+	MaxDelay        time.Duration
+	LockoutAfter    int // failures that lock the key out
+	LockoutDuration time.Duration
+	Window          time.Duration // failures are forgotten after this long without one
+}
+
+// Delay returns how long to block after the given number of failures, and
+// whether that is a lockout.
+func (p Policy) Delay(failures int) (time.Duration, bool) {
+	if p.LockoutAfter > 0 && failures >= p.LockoutAfter {
+		return p.LockoutDuration, true
+	}
+	if failures <= p.FreeFailures {
+		return 0, false
+	}
+
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(failures-p.FreeFailures-1))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay, false
+	}
+	return time.Duration(delay), false
+}
+
+// Limiter applies a policy to the keys in a store.
+type Limiter struct {
+	store  Store
+	policy Policy
+}
+
+// Result is the outcome of a recorded failure.
+type Result struct {
+	Attempts
+	Wait   time.Duration // until the key may try again
+	Locked bool          // the failure locked the key out
+}
+
+func NewLimiter(store Store, policy Policy) *Limiter {
+	return &Limiter{store: store, policy: policy}
+}
+
+// Wait returns how long the key has to wait before it may try again.
+func (l *Limiter) Wait(ctx context.Context, key string) (time.Duration, error) {
+	attempts, err := l.store.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return max(time.Until(attempts.BlockedUntil), 0), nil
+}
+
+// Fail records a failure for the key and returns how long it is now blocked.
+func (l *Limiter) Fail(ctx context.Context, key string) (Result, error) {
+	now := time.Now()
+	locked := false
+
+	attempts, err := l.store.Update(ctx, key, func(a Attempts) Attempts {
+		if now.Sub(a.LastFailure) > l.policy.Window {
+			a = Attempts{}
+		}
+		a.Failures++
+		a.LastFailure = now
+
+		var delay time.Duration
+		delay, locked = l.policy.Delay(a.Failures)
+		a.BlockedUntil = now.Add(delay)
+		return a
+	})
+	if err != nil {
+		return Result{}, err
+	}
+
+	return Result{
+		Attempts: attempts,
+		Wait:     max(time.Until(attempts.BlockedUntil), 0),
+		Locked:   locked,
+	}, nil
+}
+
+// Reset forgets the failures of the key, after it succeeded.
+func (l *Limiter) Reset(ctx context.Context, key string) error {
+	return l.store.Delete(ctx, key)
+}
@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeFailures:    2,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Second,
+	LockoutAfter:    8,
+	LockoutDuration: time.Hour,
+	Window:          time.Hour,
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		delay    time.Duration
+		locked   bool
+	}{
+		{0, 0, false},
+		{1, 0, false},
+		{2, 0, false},
+		{3, time.Second, false},
+		{4, 2 * time.Second, false},
+		{5, 4 * time.Second, false},
+		{6, 5 * time.Second, false}, // capped at MaxDelay
+		{7, 5 * time.Second, false},
+		{8, time.Hour, true},
+		{20, time.Hour, true},
+	}
+	for _, tt := range tests {
+		delay, locked := testPolicy.Delay(tt.failures)
+		if delay != tt.delay || locked != tt.locked {
+			t.Errorf("Delay(%d) = %v, %v, want %v, %v", tt.failures, delay, locked, tt.delay, tt.locked)
+		}
+	}
+}
+
+func TestDelayWithoutLockout(t *testing.T) {
+	policy := testPolicy
+	policy.LockoutAfter = 0
+	if delay, locked := policy.Delay(100); delay != policy.MaxDelay || locked {
+		t.Errorf("Delay(100) = %v, %v, want %v, false", delay, locked, policy.MaxDelay)
+	}
+}
+
+func TestLimiterFail(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewLimiter(NewMemoryStore(time.Hour), testPolicy)
+
+	for i := 1; i <= testPolicy.FreeFailures; i++ {
+		result, err := limiter.Fail(ctx, "k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Failures != i || result.Wait != 0 || result.Locked {
+			t.Fatalf("failure %d: %+v, want no wait", i, result)
+		}
+	}
+
+	result, err := limiter.Fail(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Wait <= 0 || result.Wait > testPolicy.BaseDelay || result.Locked {
+		t.Fatalf("first delayed failure: %+v, want a wait of up to %v", result, testPolicy.BaseDelay)
+	}
+
+	wait, err := limiter.Wait(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wait <= 0 || wait > testPolicy.BaseDelay {
+		t.Errorf("Wait() = %v, want up to %v", wait, testPolicy.BaseDelay)
+	}
+	if wait, _ := limiter.Wait(ctx, "other"); wait != 0 {
+		t.Errorf("Wait() of another key = %v, want 0", wait)
+	}
+
+	for result.Failures < testPolicy.LockoutAfter {
+		if result, err = limiter.Fail(ctx, "k"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !result.Locked || result.Wait <= testPolicy.MaxDelay {
+		t.Errorf("failure %d: %+v, want a lockout", result.Failures, result)
+	}
+
+	if err := limiter.Reset(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := limiter.Wait(ctx, "k"); wait != 0 {
+		t.Errorf("Wait() after Reset = %v, want 0", wait)
+	}
+	if result, _ := limiter.Fail(ctx, "k"); result.Failures != 1 {
+		t.Errorf("failures after Reset = %d, want 1", result.Failures)
+	}
+}
+
+func TestLimiterForgetsOldFailures(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(time.Hour)
+	limiter := NewLimiter(store, testPolicy)
+
+	// A key locked out long ago, and not blocked anymore
+	longAgo := time.Now().Add(-2 * testPolicy.Window)
+	store.Update(ctx, "k", func(Attempts) Attempts {
+		return Attempts{Failures: 50, LastFailure: longAgo, BlockedUntil: longAgo}
+	})
+
+	result, err := limiter.Fail(ctx, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Failures != 1 || result.Wait != 0 || result.Locked {
+		t.Errorf("Fail() after the window = %+v, want a fresh first failure", result)
+	}
+
+	// Within the window failures keep adding up
+	recent := time.Now().Add(-time.Minute)
+	store.Update(ctx, "k", func(Attempts) Attempts {
+		return Attempts{Failures: testPolicy.LockoutAfter - 1, LastFailure: recent, BlockedUntil: recent}
+	})
+	if result, _ := limiter.Fail(ctx, "k"); !result.Locked {
+		t.Errorf("Fail() within the window = %+v, want a lockout", result)
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore(time.Hour)
+	longAgo := time.Now().Add(-2 * time.Hour)
+
+	store.Update(ctx, "old", func(Attempts) Attempts {
+		return Attempts{Failures: 1, LastFailure: longAgo}
+	})
+	store.Update(ctx, "blocked", func(Attempts) Attempts {
+		return Attempts{Failures: 9, LastFailure: longAgo, BlockedUntil: time.Now().Add(time.Hour)}
+	})
+
+	store.lastPruned = time.Now().Add(-pruneInterval)
+	store.Update(ctx, "new", func(a Attempts) Attempts { return a })
+
+	if _, ok := store.attempts["old"]; ok {
+		t.Error("expired key was not pruned")
+	}
+	if _, ok := store.attempts["blocked"]; !ok {
+		t.Error("blocked key was pruned")
+	}
+}
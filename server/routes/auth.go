@@ -2,17 +2,27 @@ package routes
 
 import (
 	"context"
+	"errors"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"time"
 
 	"shared-expenses-app/db"
+	"shared-expenses-app/mailer"
 	"shared-expenses-app/models"
+	"shared-expenses-app/oidc"
+	"shared-expenses-app/ratelimit"
 	"shared-expenses-app/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func RegisterAuthRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
+func RegisterAuthRoutes(router *gin.RouterGroup, pool *pgxpool.Pool, mail mailer.Mailer, providers oidc.Providers, attempts ratelimit.Store) {
+	throttle := newLoginThrottle(pool, attempts)
+
 	// Register a new user
 	router.POST("/register", func(c *gin.Context) {
 		var request struct {
@@ -55,8 +65,15 @@ func RegisterAuthRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 			return
 		}
 
+		// The account stays unverified until the emailed link is opened
+		inBackground("verification email", func(ctx context.Context) error {
+			return sendEmailVerification(ctx, pool, mail, models.User{UserID: userID, Name: name, Email: &email})
+		})
+
+		// Groups that invited the email are joined once it is verified, so nobody
+		// gets into them by registering someone else's address first
 		c.JSON(http.StatusOK, gin.H{
-			"message": "user registered successfully",
+			"message": "user registered successfully, check your email to verify your account",
 			"user_id": userID,
 		})
 	})
@@ -64,8 +81,9 @@ func RegisterAuthRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 	// POST /auth - Login endpoint
 	router.POST("/login", func(c *gin.Context) {
 		var request struct {
-			Email    string `json:"email" binding:"required,email"`
-			Password string `json:"password" binding:"required"`
+			Email      string `json:"email" binding:"required,email"`
+			Password   string `json:"password" binding:"required"`
+			DeviceName string `json:"device_name"`
 		}
 
 		// Convert request JSON body to struct
@@ -82,35 +100,500 @@ func RegisterAuthRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 
 		password := request.Password
 
+		// Back off repeated failures before spending time on bcrypt
+		if !throttle.allow(c, email) {
+			return
+		}
+
 		userID, savedPassword, err := db.GetUserCredentials(context.Background(), pool, email)
 		if err != nil {
+			throttle.fail(c, email)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
 			return
 		}
 
 		if ok := utils.CheckPassword(password, savedPassword); !ok {
+			throttle.fail(c, email)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
 			return
 		}
 
-		// At this point, login is successful
+		// At this point, the password is correct
+		throttle.succeed(c, email)
+		completeLogin(c, pool, userID, request.DeviceName)
+	})
+
+	registerTwoFactorRoutes(router, pool, throttle)
+	registerOIDCRoutes(router, pool, providers)
+	registerTokenRoutes(router, pool)
+
+	// Exchange a refresh token for a new access and refresh token
+	router.POST("/refresh", func(c *gin.Context) {
+		var request struct {
+			RefreshToken string `json:"refresh_token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		expiry, err := utils.RefreshTokenExpiry()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+		refreshToken, refreshHash, err := utils.GenerateToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+
+		userID, sessionID, err := db.RotateRefreshToken(
+			c.Request.Context(), pool, utils.HashToken(request.RefreshToken), refreshHash, time.Now().Add(expiry),
+			sessionClient(c, "", ""),
+		)
+		if err != nil {
+			if errors.Is(err, db.ErrInvalidRefreshToken) || errors.Is(err, db.ErrRefreshTokenReused) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
 
-		token, err := utils.GenerateJWT(userID)
+		token, err := utils.GenerateJWT(userID, sessionID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
 			return
 		}
 
-		// Return JWT token
-		c.JSON(http.StatusOK, gin.H{
-			"message": "login successful",
-			"token":   token,
+		c.JSON(http.StatusOK, tokenResponse(token, refreshToken))
+	})
+
+	// Log out, revoking every refresh token of the session
+	router.POST("/logout", func(c *gin.Context) {
+		var request struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		var err error
+		if request.RefreshToken != "" {
+			err = db.RevokeTokenFamilyOf(c.Request.Context(), pool, utils.HashToken(request.RefreshToken))
+		} else {
+			// Without a refresh token, log out the session of the access token
+			authHeader := c.GetHeader("Authorization")
+			userID, extractErr := currentUser(c)
+			if extractErr != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": extractErr.Error()})
+				return
+			}
+			sessionID, extractErr := utils.ExtractSessionID(authHeader)
+			if extractErr != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": extractErr.Error()})
+				return
+			}
+			err = db.RevokeTokenFamily(c.Request.Context(), pool, userID, sessionID)
+		}
+		if err != nil {
+			if errors.Is(err, db.ErrInvalidRefreshToken) || errors.Is(err, db.ErrSessionNotFound) {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+	})
+
+	// Email a password reset link. The response is the same whether or not the
+	// email is registered, and the email is sent in the background so the
+	// response time doesn't tell either.
+	router.POST("/password/forgot", func(c *gin.Context) {
+		var request struct {
+			Email string `json:"email" binding:"required,email"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		email, err := utils.ValidateEmail(request.Email)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		inBackground("password reset email", func(ctx context.Context) error {
+			return sendPasswordReset(ctx, pool, mail, email)
+		})
+
+		c.JSON(http.StatusOK, gin.H{"message": "if the email is registered, a reset link has been sent"})
+	})
+
+	// Set a new password with a reset token, signing out every session
+	router.POST("/password/reset", func(c *gin.Context) {
+		var request struct {
+			Token    string `json:"token" binding:"required"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		passwordHash, err := utils.HashPassword(request.Password)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		_, err = db.ResetPassword(c.Request.Context(), pool, utils.HashToken(request.Token), passwordHash)
+		if err != nil {
+			if errors.Is(err, db.ErrInvalidResetToken) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "password reset, please log in again"})
+	})
+
+	// Change the password, signing out every other session
+	router.POST("/password/change", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		var request struct {
+			CurrentPassword string `json:"current_password" binding:"required"`
+			NewPassword     string `json:"new_password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if _, ok := checkCurrentPassword(c, pool, throttle, userID, request.CurrentPassword); !ok {
+			return
+		}
+
+		passwordHash, err := utils.HashPassword(request.NewPassword)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sessionID, _ := utils.ExtractSessionID(c.GetHeader("Authorization"))
+		if err := db.ChangePassword(c.Request.Context(), pool, userID, passwordHash, sessionID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "password changed, other sessions signed out"})
+	})
+
+	// Merge a duplicate account into this one. Signing in to the duplicate proves
+	// it is the same person: its password, and its two-factor code if enabled.
+	router.POST("/merge", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		var request struct {
+			Email    string `json:"email" binding:"required,email"`
+			Password string `json:"password" binding:"required"`
+			Code     string `json:"code"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		email, err := utils.ValidateEmail(request.Email)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !throttle.allow(c, email) {
+			return
+		}
+		duplicateID, savedPassword, err := db.GetUserCredentials(c.Request.Context(), pool, email)
+		if err != nil || !utils.CheckPassword(request.Password, savedPassword) {
+			throttle.fail(c, email)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
+			return
+		}
+		throttle.succeed(c, email)
+
+		if duplicateID == userID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot merge an account into itself"})
+			return
+		}
+
+		totp, err := db.GetTOTP(c.Request.Context(), pool, duplicateID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if totp.Enabled {
+			account := "2fa:" + duplicateID
+			if !throttle.allow(c, account) {
+				return
+			}
+			ok, err := checkSecondFactor(c.Request.Context(), pool, duplicateID, request.Code)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !ok {
+				throttle.fail(c, account)
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two-factor code"})
+				return
+			}
+			throttle.succeed(c, account)
+		}
+
+		if err := db.MergeAccounts(c.Request.Context(), pool, duplicateID, userID); err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "accounts merged", "merged_user_id": duplicateID})
+	})
+
+	// Ask to change the email. Nothing changes until the link sent to the new
+	// address is opened.
+	router.POST("/email/change", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		var request struct {
+			NewEmail string `json:"new_email" binding:"required,email"`
+			Password string `json:"password" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		newEmail, err := utils.ValidateEmail(request.NewEmail)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, ok := checkCurrentPassword(c, pool, throttle, userID, request.Password)
+		if !ok {
+			return
+		}
+		if newEmail == user.EmailAddress() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "new email is the current email"})
+			return
+		}
+
+		_, err = db.GetUserFromEmail(c.Request.Context(), pool, newEmail)
+		if err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": db.ErrEmailTaken.Error()})
+			return
+		}
+		if !errors.Is(err, db.ErrEmailNotRegistered) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := sendEmailChange(c.Request.Context(), pool, mail, user, newEmail); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send confirmation email"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "confirmation email sent to the new address"})
+	})
+
+	// Confirm a new email with the token from the emailed link, switching to it
+	// and signing out every other session
+	router.POST("/email/confirm", func(c *gin.Context) {
+		var request struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// The link may be opened signed out or on another device, then every session goes
+		sessionID, _ := utils.ExtractSessionID(c.GetHeader("Authorization"))
+
+		userID, oldEmail, err := db.ConfirmEmailChange(c.Request.Context(), pool, utils.HashToken(request.Token), sessionID)
+		if err != nil {
+			switch {
+			case errors.Is(err, db.ErrInvalidVerificationToken):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			case errors.Is(err, db.ErrEmailTaken):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		// Let the old address know, in case the change wasn't theirs
+		inBackground("email change notice", func(ctx context.Context) error {
+			user, err := db.GetUser(ctx, pool, userID)
+			if err != nil {
+				return err
+			}
+			joinInvitedGroups(ctx, pool, userID, user.EmailAddress())
+			return mail.Send(ctx, mailer.Message{
+				To:      oldEmail,
+				Subject: "Your email was changed",
+				Body: "Hi " + user.Name + ",\n\n" +
+					"The email of your account was changed to " + user.EmailAddress() + ".\n\n" +
+					"If you didn't do this, reset your password and contact the server administrator.",
+			})
 		})
+
+		c.JSON(http.StatusOK, gin.H{"message": "email changed"})
+	})
+
+	// Verify an email address with the token from the emailed link
+	router.POST("/verify-email", func(c *gin.Context) {
+		var request struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := db.VerifyEmail(c.Request.Context(), pool, utils.HashToken(request.Token))
+		if err != nil {
+			if errors.Is(err, db.ErrInvalidVerificationToken) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		user, err := db.GetUser(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		joinedGroups := joinInvitedGroups(c.Request.Context(), pool, userID, user.EmailAddress())
+
+		c.JSON(http.StatusOK, gin.H{"message": "email verified", "joined_groups": joinedGroups})
+	})
+
+	// Send the verification email again
+	router.POST("/verify-email/resend", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := db.GetUser(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.Verified {
+			c.JSON(http.StatusConflict, gin.H{"error": "email already verified"})
+			return
+		}
+
+		if err := sendEmailVerification(c.Request.Context(), pool, mail, user); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send verification email"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "verification email sent"})
+	})
+
+	// List signed-in devices
+	router.GET("/sessions", func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		currentID, _ := utils.ExtractSessionID(authHeader)
+
+		sessions, err := db.ActiveSessions(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].SessionID == currentID
+		}
+
+		c.JSON(http.StatusOK, sessions)
+	})
+
+	// Revoke a session, or every session except the current one with /sessions/others
+	router.DELETE("/sessions/:id", func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		if c.Param("id") == "others" {
+			currentID, err := utils.ExtractSessionID(authHeader)
+			if err != nil {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+
+			revoked, err := db.RevokeOtherSessions(c.Request.Context(), pool, userID, currentID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": "other sessions revoked", "revoked": revoked})
+			return
+		}
+
+		err = db.RevokeTokenFamily(c.Request.Context(), pool, userID, c.Param("id"))
+		if err != nil {
+			if errors.Is(err, db.ErrSessionNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
 	})
 
 	// Logged in user details
 	router.GET("/me", func(c *gin.Context) {
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
+		userID, err := currentUser(c)
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 			return
@@ -127,3 +610,227 @@ func RegisterAuthRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 		c.JSON(http.StatusOK, user)
 	})
 }
+
+// completeLogin finishes a login once the user proved who they are, either with
+// a password or through an OIDC provider. With two-factor enabled, it responds
+// with a challenge for the second step instead of tokens.
+func completeLogin(c *gin.Context, pool *pgxpool.Pool, userID, deviceName string) {
+	totp, err := db.GetTOTP(c.Request.Context(), pool, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if totp.Enabled {
+		challenge, err := utils.GenerateChallengeJWT(userID, deviceName)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":             "two-factor code required",
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+		})
+		return
+	}
+
+	tokens, err := issueTokens(c.Request.Context(), pool, sessionClient(c, userID, deviceName))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+		return
+	}
+
+	// Return access and refresh tokens
+	tokens["message"] = "login successful"
+	c.JSON(http.StatusOK, tokens)
+}
+
+// sessionClient describes the device making the request, for the session list.
+func sessionClient(c *gin.Context, userID, deviceName string) models.Session {
+	return models.Session{
+		UserID:     userID,
+		DeviceName: deviceName,
+		IPAddress:  c.ClientIP(),
+		UserAgent:  c.Request.UserAgent(),
+	}
+}
+
+// issueTokens starts a new session (token family) on the given device and returns
+// the access and refresh tokens to send back.
+func issueTokens(ctx context.Context, pool *pgxpool.Pool, session models.Session) (gin.H, error) {
+	expiry, err := utils.RefreshTokenExpiry()
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refreshHash, err := utils.GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID, err := db.CreateTokenFamily(ctx, pool, session, refreshHash, time.Now().Add(expiry))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := utils.GenerateJWT(session.UserID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokenResponse(token, refreshToken), nil
+}
+
+func tokenResponse(token, refreshToken string) gin.H {
+	response := gin.H{
+		"token":         token,
+		"refresh_token": refreshToken,
+	}
+	if expiry, err := utils.AccessTokenExpiry(); err == nil {
+		response["expires_in"] = int(expiry.Seconds())
+	}
+	return response
+}
+
+// sendPasswordReset emails a password reset link to the user with the given email.
+// Unregistered emails are silently ignored.
+func sendPasswordReset(ctx context.Context, pool *pgxpool.Pool, mail mailer.Mailer, email string) error {
+	user, err := db.GetUserFromEmail(ctx, pool, email)
+	if err != nil {
+		if errors.Is(err, db.ErrEmailNotRegistered) {
+			return nil
+		}
+		return err
+	}
+
+	expiry, err := utils.PasswordResetExpiry()
+	if err != nil {
+		return err
+	}
+	token, tokenHash, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+	if err := db.CreatePasswordReset(ctx, pool, user.UserID, tokenHash, time.Now().Add(expiry)); err != nil {
+		return err
+	}
+
+	link := utils.Getenv("APP_URL", "http://localhost:8080") + "/reset-password?token=" + url.QueryEscape(token)
+	return mail.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Reset your password",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Someone asked to reset the password of your account. Open this link to choose a new one:\n\n" +
+			link + "\n\n" +
+			"The link expires in " + expiry.String() + " and can be used once. " +
+			"If you didn't ask for this, you can ignore this email.",
+	})
+}
+
+// sendEmailVerification emails a link that verifies the user's current email.
+func sendEmailVerification(ctx context.Context, pool *pgxpool.Pool, mail mailer.Mailer, user models.User) error {
+	expiry, err := utils.EmailVerificationExpiry()
+	if err != nil {
+		return err
+	}
+	token, tokenHash, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+	if err := db.CreateEmailVerification(ctx, pool, user.UserID, user.EmailAddress(), tokenHash, time.Now().Add(expiry)); err != nil {
+		return err
+	}
+
+	link := utils.Getenv("APP_URL", "http://localhost:8080") + "/verify-email?token=" + url.QueryEscape(token)
+	return mail.Send(ctx, mailer.Message{
+		To:      user.EmailAddress(),
+		Subject: "Verify your email",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Open this link to verify the email of your account:\n\n" +
+			link + "\n\n" +
+			"The link expires in " + expiry.String() + ". " +
+			"If you didn't create an account, you can ignore this email.",
+	})
+}
+
+// sendEmailChange emails the link that confirms a new email of the user.
+func sendEmailChange(ctx context.Context, pool *pgxpool.Pool, mail mailer.Mailer, user models.User, newEmail string) error {
+	expiry, err := utils.EmailVerificationExpiry()
+	if err != nil {
+		return err
+	}
+	token, tokenHash, err := utils.GenerateToken()
+	if err != nil {
+		return err
+	}
+	if err := db.CreateEmailChange(ctx, pool, user.UserID, newEmail, tokenHash, time.Now().Add(expiry)); err != nil {
+		return err
+	}
+
+	link := utils.Getenv("APP_URL", "http://localhost:8080") + "/confirm-email?token=" + url.QueryEscape(token)
+	return mail.Send(ctx, mailer.Message{
+		To:      newEmail,
+		Subject: "Confirm your new email",
+		Body: "Hi " + user.Name + ",\n\n" +
+			"Open this link to use this address for your account:\n\n" +
+			link + "\n\n" +
+			"The link expires in " + expiry.String() + ". " +
+			"If you didn't ask for this, you can ignore this email.",
+	})
+}
+
+// checkCurrentPassword confirms a signed-in user's password before a sensitive
+// change, throttled like logins. Responds and returns false if it is wrong.
+func checkCurrentPassword(c *gin.Context, pool *pgxpool.Pool, throttle *loginThrottle, userID, password string) (models.User, bool) {
+	user, err := db.GetUser(c.Request.Context(), pool, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return models.User{}, false
+	}
+
+	if !throttle.allow(c, user.EmailAddress()) {
+		return models.User{}, false
+	}
+
+	_, savedPassword, err := db.GetUserCredentials(c.Request.Context(), pool, user.EmailAddress())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return models.User{}, false
+	}
+	if savedPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "account has no password, set one with a password reset first"})
+		return models.User{}, false
+	}
+	if !utils.CheckPassword(password, savedPassword) {
+		throttle.fail(c, user.EmailAddress())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid password"})
+		return models.User{}, false
+	}
+
+	throttle.succeed(c, user.EmailAddress())
+	return user, true
+}
+
+// joinInvitedGroups accepts the email invites of a user whose email can be trusted
+// and returns the groups joined. Failures are logged rather than failing the
+// request, since the account itself is fine.
+func joinInvitedGroups(ctx context.Context, pool *pgxpool.Pool, userID, email string) []string {
+	groupIDs, err := db.AcceptEmailInvites(ctx, pool, userID, email)
+	if err != nil {
+		log.Printf("accepting email invites failed: %v", err)
+		return []string{}
+	}
+	return groupIDs
+}
+
+// inBackground runs fn after the response is sent, logging its error.
+// Used for emails, so that slow mail servers don't hold up requests.
+func inBackground(what string, fn func(ctx context.Context) error) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := fn(ctx); err != nil {
+			log.Printf("%s failed: %v", what, err)
+		}
+	}()
+}
@@ -1,12 +1,15 @@
 package routes
 
 import (
+	"context"
+	"errors"
 	"math"
 	"net/http"
 	"strconv"
 
 	"shared-expenses-app/db"
 	"shared-expenses-app/models"
+	"shared-expenses-app/policy"
 	"shared-expenses-app/utils"
 
 	"github.com/gin-gonic/gin"
@@ -15,13 +18,8 @@ import (
 
 func RegisterExpensesRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 	// Create expense with splits
-	router.POST("/", func(c *gin.Context) {
-		// Authenticate user
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
+	router.POST("/", authorize(pool, groupInBody, policy.Contributor), func(c *gin.Context) {
+		userID := requestUser(c)
 
 		var expense models.Expense
 		if err := c.ShouldBindJSON(&expense); err != nil {
@@ -29,56 +27,25 @@ func RegisterExpensesRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 			return
 		}
 		expense.AddedBy = userID
-
-		// Check user is in group
-		if err := db.MemberOfGroup(c, pool, userID, expense.GroupID); err != nil {
-			c.JSON(http.StatusForbidden, gin.H{"error": "user not a member of group"})
-			return
+		expense.RefundOf = nil // refunds are recorded through /expenses/:id/refunds
+		if expense.Kind == "" {
+			expense.Kind = models.ExpenseKindSpend
 		}
-
-		// Validate splits
-		if len(expense.Splits) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "no splits provided"})
+		if expense.Kind == models.ExpenseKindRefund {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refunds are recorded against the refunded expense"})
 			return
 		}
 
-		// Collect user IDs and calculate paid/owed totals
-		splitUserIDs := make([]string, 0, len(expense.Splits))
-		var paidTotal, owedTotal float64
-		for _, s := range expense.Splits {
-			splitUserIDs = append(splitUserIDs, s.UserID)
-			if s.IsPaid {
-				paidTotal += s.Amount
-			} else {
-				owedTotal += s.Amount
-			}
-		}
-
-		// Get unique user IDs (same user can appear multiple times with different is_paid values)
-		uniqueUserIDs := utils.GetUniqueUserIDs(splitUserIDs)
-
-		// Check all split users are in group (single DB call)
-		if err := db.AllMembersOfGroup(c, pool, uniqueUserIDs, expense.GroupID); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "split user not in group"})
+		// Compute owed splits from the group weights if requested
+		if err := applyGroupWeights(c, pool, &expense); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		// Skip amount validation if incomplete flags are set
-		if !expense.IsIncompleteAmount && !expense.IsIncompleteSplit {
-			tolerance, err := strconv.ParseFloat(utils.Getenv("SPLIT_TOLERANCE", "0.01"), 64)
-			if err != nil {
-				tolerance = 0.01
-			}
-			// Validate: paid amounts should equal expense amount
-			if math.Abs(paidTotal-expense.Amount) > tolerance {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "paid split total does not match expense amount"})
-				return
-			}
-			// Validate: owed amounts should equal expense amount
-			if math.Abs(owedTotal-expense.Amount) > tolerance {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "owed split total does not match expense amount"})
-				return
-			}
+		// Validate splits
+		if err := validateSplits(c, pool, expense); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		// Create expense
@@ -92,14 +59,7 @@ func RegisterExpensesRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 	})
 
 	// Get expense by ID
-	router.GET("/:id", func(c *gin.Context) {
-		// Authenticate user
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
-
+	router.GET("/:id", authorize(pool, expenseParam, policy.Member), func(c *gin.Context) {
 		expenseID := c.Param("id")
 		expense, err := db.GetExpense(c, pool, expenseID)
 		if err != nil {
@@ -107,23 +67,21 @@ func RegisterExpensesRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 			return
 		}
 
-		// Must be group member
-		if err := db.MemberOfGroup(c, pool, userID, expense.GroupID); err != nil {
-			c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-			return
+		// Show what is left of the expense after its refunds
+		if expense.RefundOf == nil {
+			expense.Refunds, err = db.ExpenseRefunds(c, pool, expenseID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			applyRefunds(&expense)
 		}
 
 		c.JSON(http.StatusOK, expense)
 	})
 
 	// Update expense (with splits)
-	router.PUT("/:id", func(c *gin.Context) {
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
-
+	router.PUT("/:id", authorize(pool, expenseParam, policy.AnyOf(policy.Adder, policy.Admin)), func(c *gin.Context) {
 		expenseID := c.Param("id")
 		if expenseID == "" {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "missing expense id"})
@@ -144,100 +102,169 @@ func RegisterExpensesRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 			return
 		}
 
-		// Get group creator to verify ownership
-		groupCreator, err := db.GetGroupCreator(c, pool, exp.GroupID)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch group"})
+		payload.GroupID = exp.GroupID
+		payload.AddedBy = exp.AddedBy
+
+		// Refunds stay refunds, and nothing else can become one
+		if payload.Kind == "" || exp.Kind == models.ExpenseKindRefund {
+			payload.Kind = exp.Kind
+		}
+		if payload.Kind == models.ExpenseKindRefund && exp.Kind != models.ExpenseKindRefund {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refunds are recorded against the refunded expense"})
 			return
 		}
 
-		// Authorization: only expense adder or group creator
-		if userID != exp.AddedBy && userID != groupCreator {
-			c.JSON(http.StatusForbidden, gin.H{"error": "not authorized"})
+		// Compute owed splits from the weights sent, or else from the weights the
+		// expense was split with. Only refresh_weights=true (or switching to weights)
+		// takes the group's current weights.
+		weights := payload.Weights
+		if len(weights) == 0 && exp.SplitMode == models.SplitModeWeights && c.Query("refresh_weights") != "true" {
+			weights = exp.Weights
+		}
+		if err := applyWeights(c, pool, &payload, weights); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
 		// Validate splits
-		if len(payload.Splits) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "no splits provided"})
+		if err := validateSplits(c, pool, payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		// Collect user IDs and calculate paid/owed totals
-		splitUserIDs := make([]string, 0, len(payload.Splits))
-		var paidTotal, owedTotal float64
-		for _, s := range payload.Splits {
-			splitUserIDs = append(splitUserIDs, s.UserID)
-			if s.IsPaid {
-				paidTotal += s.Amount
+		// Refunds can never add up to more than the refunded expense, which stays spending
+		if err := db.UpdateExpense(c, pool, payload, splitTolerance()); err != nil {
+			if errors.Is(err, db.ErrRefundsExceedExpense) || errors.Is(err, db.ErrExpenseHasRefunds) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			} else {
-				owedTotal += s.Amount
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "expense updated"})
+	})
+
+	// Refund part or all of an expense
+	router.POST("/:id/refunds", authorize(pool, expenseParam, policy.Contributor), func(c *gin.Context) {
+		userID := requestUser(c)
+
+		var request struct {
+			Amount      float64               `json:"amount" binding:"required,gt=0"`
+			Title       string                `json:"title"`
+			Description string                `json:"description"`
+			Splits      []models.ExpenseSplit `json:"splits"` // optional, defaults to reversing the original in proportion
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		original, err := db.GetExpense(c, pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "expense not found"})
+			return
 		}
 
-		// Check all split users are in group
-		if err := db.AllMembersOfGroup(c, pool, splitUserIDs, exp.GroupID); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "split user not in group"})
+		if original.Kind != models.ExpenseKindSpend {
+			c.JSON(http.StatusBadRequest, gin.H{"error": db.ErrNotRefundable.Error()})
+			return
+		}
+		if original.IsIncompleteAmount || original.IsIncompleteSplit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot refund an incomplete expense"})
 			return
 		}
 
-		// Skip amount validation if incomplete flags are set
-		if !payload.IsIncompleteAmount && !payload.IsIncompleteSplit {
-			tolerance, err := strconv.ParseFloat(utils.Getenv("SPLIT_TOLERANCE", "0.01"), 64)
+		refund := models.Expense{
+			GroupID:     original.GroupID,
+			AddedBy:     userID,
+			Title:       request.Title,
+			Description: request.Description,
+			Category:    original.Category,
+			Amount:      request.Amount,
+			Kind:        models.ExpenseKindRefund,
+			SplitMode:   models.SplitModeExact,
+			RefundOf:    &original.ExpenseID,
+			Splits:      request.Splits,
+		}
+		if refund.Title == "" {
+			refund.Title = "Refund: " + original.Title
+		}
+		if len(refund.Splits) == 0 {
+			refund.Splits, err = refundSplits(original, request.Amount)
 			if err != nil {
-				tolerance = 0.01
-			}
-			// Validate: paid amounts should equal expense amount
-			if math.Abs(paidTotal-payload.Amount) > tolerance {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "paid split total does not match expense amount"})
-				return
-			}
-			// Validate: owed amounts should equal expense amount
-			if math.Abs(owedTotal-payload.Amount) > tolerance {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "owed split total does not match expense amount"})
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 				return
 			}
 		}
 
-		if err := db.UpdateExpense(c, pool, payload); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		// Validate splits
+		if err := validateSplits(c, pool, refund); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "expense updated"})
-	})
-
-	// Delete expense
-	router.DELETE("/:id", func(c *gin.Context) {
-		// Authenticate user
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
+		// Checked against the other refunds while the original is locked
+		refundID, err := db.CreateRefund(c, pool, refund, splitTolerance())
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			if errors.Is(err, db.ErrRefundsExceedExpense) || errors.Is(err, db.ErrNotRefundable) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
 
-		expenseID := c.Param("id")
-		if expenseID == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "missing expense id"})
+		c.JSON(http.StatusOK, gin.H{"expense_id": refundID})
+	})
+
+	// Confirm own share of a pending expense
+	router.POST("/:id/confirm", authorize(pool, expenseParam, policy.Member), func(c *gin.Context) {
+		userID := requestUser(c)
+
+		status, err := db.RespondToExpense(c, pool, c.Param("id"), userID, models.ConfirmationConfirmed, "")
+		if err != nil {
+			if errors.Is(err, db.ErrNoConfirmation) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
 
-		expense, err := db.GetExpense(c, pool, expenseID)
-		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "expense not found"})
+		c.JSON(http.StatusOK, gin.H{"message": "share confirmed", "status": status})
+	})
+
+	// Dispute own share of a pending expense
+	router.POST("/:id/dispute", authorize(pool, expenseParam, policy.Member), func(c *gin.Context) {
+		userID := requestUser(c)
+
+		var request struct {
+			Reason string `json:"reason" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "reason required"})
 			return
 		}
 
-		// Get group creator to verify ownership
-		groupCreator, err := db.GetGroupCreator(c, pool, expense.GroupID)
+		status, err := db.RespondToExpense(c, pool, c.Param("id"), userID, models.ConfirmationDisputed, request.Reason)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch group"})
+			if errors.Is(err, db.ErrNoConfirmation) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
 
-		// Authorization: only adder or owner
-		if userID != expense.AddedBy && userID != groupCreator {
-			c.JSON(http.StatusForbidden, gin.H{"error": "not authorized"})
+		c.JSON(http.StatusOK, gin.H{"message": "share disputed", "status": status})
+	})
+
+	// Delete expense
+	router.DELETE("/:id", authorize(pool, expenseParam, policy.AnyOf(policy.Adder, policy.Admin)), func(c *gin.Context) {
+		expenseID := c.Param("id")
+		if expenseID == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "missing expense id"})
 			return
 		}
 
@@ -249,3 +276,249 @@ func RegisterExpensesRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 		c.JSON(http.StatusOK, gin.H{"message": "expense deleted"})
 	})
 }
+
+// validateSplits checks that the expense has splits, that every split user is a
+// member of the expense's group and that the splits fit the kind of expense.
+// Unless the expense is flagged incomplete, both the paid and the owed totals
+// must match the expense amount.
+func validateSplits(ctx context.Context, pool *pgxpool.Pool, expense models.Expense) error {
+	switch expense.Kind {
+	case models.ExpenseKindSpend, models.ExpenseKindTransfer, models.ExpenseKindIncome, models.ExpenseKindRefund:
+	default:
+		return errors.New("invalid expense kind")
+	}
+
+	if len(expense.Splits) == 0 {
+		return errors.New("no splits provided")
+	}
+
+	// Collect user IDs and calculate paid/owed totals
+	splitUserIDs := make([]string, 0, len(expense.Splits))
+	var paidTotal, owedTotal float64
+	var payers, owers []string
+	for _, s := range expense.Splits {
+		splitUserIDs = append(splitUserIDs, s.UserID)
+		if s.IsPaid {
+			paidTotal += s.Amount
+			payers = append(payers, s.UserID)
+		} else {
+			owedTotal += s.Amount
+			owers = append(owers, s.UserID)
+		}
+	}
+
+	// Get unique user IDs (same user can appear multiple times with different is_paid values)
+	uniqueUserIDs := utils.GetUniqueUserIDs(splitUserIDs)
+
+	// Check all split users are in group (single DB call). Former members may stay
+	// in the expense they were part of, or in refunds of it, and can still settle
+	// up with transfers.
+	existingID := expense.ExpenseID
+	if existingID == "" && expense.RefundOf != nil {
+		existingID = *expense.RefundOf
+	}
+	err := db.AllMembersOfGroup(ctx, pool, uniqueUserIDs, expense.GroupID, existingID)
+	if errors.Is(err, db.ErrNotMember) && expense.Kind == models.ExpenseKindTransfer {
+		err = db.FormerOrCurrentMembers(ctx, pool, uniqueUserIDs, expense.GroupID)
+	}
+	if err != nil {
+		return errors.New("split user not in group")
+	}
+
+	if utils.RestrictUnverifiedUsers() {
+		unverified, err := db.UnverifiedUsers(ctx, pool, uniqueUserIDs)
+		if err != nil {
+			return err
+		}
+		if len(unverified) > 0 {
+			return errors.New("split user has not verified their email")
+		}
+	}
+
+	// Transfers move a known amount from exactly one member to another
+	if expense.Kind == models.ExpenseKindTransfer {
+		if expense.IsIncompleteAmount || expense.IsIncompleteSplit {
+			return errors.New("transfers cannot be incomplete")
+		}
+		if len(payers) != 1 || len(owers) != 1 {
+			return errors.New("transfers need exactly one sender and one recipient")
+		}
+		if payers[0] == owers[0] {
+			return errors.New("cannot transfer to the same user")
+		}
+	}
+
+	// Skip amount validation if incomplete flags are set
+	if expense.IsIncompleteAmount || expense.IsIncompleteSplit {
+		return nil
+	}
+
+	tolerance := splitTolerance()
+	// Validate: paid amounts should equal expense amount (received, for income and refunds)
+	if math.Abs(paidTotal-expense.Amount) > tolerance {
+		return errors.New("paid split total does not match expense amount")
+	}
+	// Validate: owed amounts should equal expense amount
+	if math.Abs(owedTotal-expense.Amount) > tolerance {
+		return errors.New("owed split total does not match expense amount")
+	}
+
+	return nil
+}
+
+// applyGroupWeights replaces the owed splits of a weights split expense with shares
+// of the amount computed from the group's member weights, and keeps those weights
+// as the expense's snapshot. Exact split expenses are left as they are.
+func applyGroupWeights(ctx context.Context, pool *pgxpool.Pool, expense *models.Expense) error {
+	return applyWeights(ctx, pool, expense, nil)
+}
+
+// applyWeights is applyGroupWeights with the given snapshot of weights instead,
+// unless it is empty.
+func applyWeights(ctx context.Context, pool *pgxpool.Pool, expense *models.Expense, weights []models.MemberWeight) error {
+	switch expense.SplitMode {
+	case "", models.SplitModeExact:
+		expense.SplitMode = models.SplitModeExact
+		expense.Weights = nil
+		return nil
+	case models.SplitModeWeights:
+		if expense.Kind == models.ExpenseKindTransfer {
+			return errors.New("transfers cannot be split by weights")
+		}
+	default:
+		return errors.New("invalid split mode")
+	}
+
+	if len(weights) > 0 {
+		userIDs := make([]string, 0, len(weights))
+		for _, w := range weights {
+			userIDs = append(userIDs, w.UserID)
+		}
+		if len(utils.GetUniqueUserIDs(userIDs)) != len(weights) {
+			return errors.New("each user can only have one weight")
+		}
+	} else {
+		var err error
+		weights, err = db.GroupWeights(ctx, pool, expense.GroupID)
+		if err != nil {
+			return err
+		}
+		if len(weights) == 0 {
+			return errors.New("group has no member weights")
+		}
+	}
+
+	values := make([]float64, len(weights))
+	for i, w := range weights {
+		values[i] = w.Weight
+	}
+	shares, err := utils.SplitByWeights(expense.Amount, values)
+	if err != nil {
+		return err
+	}
+
+	// Keep the payers, the owers come from the weights
+	splits := make([]models.ExpenseSplit, 0, len(expense.Splits)+len(weights))
+	for _, s := range expense.Splits {
+		if s.IsPaid {
+			splits = append(splits, s)
+		}
+	}
+	for i, w := range weights {
+		splits = append(splits, models.ExpenseSplit{UserID: w.UserID, Amount: shares[i]})
+	}
+
+	expense.Splits = splits
+	expense.Weights = weights
+	return nil
+}
+
+// splitTolerance returns how far split totals may drift from the expense amount.
+func splitTolerance() float64 {
+	tolerance, err := strconv.ParseFloat(utils.Getenv("SPLIT_TOLERANCE", "0.01"), 64)
+	if err != nil {
+		return 0.01
+	}
+	return tolerance
+}
+
+// refundSplits reverses the splits of an expense in proportion to the refunded
+// amount. Refund splits mirror the original: the paid side is who gets the money
+// back, the owed side is how the refund is shared.
+func refundSplits(original models.Expense, amount float64) ([]models.ExpenseSplit, error) {
+	var splits []models.ExpenseSplit
+	for _, isPaid := range []bool{true, false} {
+		var side []models.ExpenseSplit
+		var weights []float64
+		for _, s := range original.Splits {
+			if s.IsPaid == isPaid {
+				side = append(side, s)
+				weights = append(weights, s.Amount)
+			}
+		}
+
+		parts, err := utils.SplitByWeights(amount, weights)
+		if err != nil {
+			return nil, errors.New("expense has no splits to refund")
+		}
+		for i, s := range side {
+			splits = append(splits, models.ExpenseSplit{UserID: s.UserID, Amount: parts[i], IsPaid: isPaid})
+		}
+	}
+	return splits, nil
+}
+
+// applyRefunds sets the net amount and net splits of an expense, which is what
+// remains once its approved refunds are taken off.
+func applyRefunds(expense *models.Expense) {
+	type splitKey struct {
+		userID string
+		isPaid bool
+	}
+
+	net := expense.Amount
+	remaining := make(map[splitKey]float64, len(expense.Splits))
+	for _, s := range expense.Splits {
+		remaining[splitKey{s.UserID, s.IsPaid}] += s.Amount
+	}
+	for _, r := range expense.Refunds {
+		if r.Status != models.ExpenseStatusApproved {
+			continue
+		}
+		net -= r.Amount
+		for _, s := range r.Splits {
+			remaining[splitKey{s.UserID, s.IsPaid}] -= s.Amount
+		}
+	}
+
+	net = utils.RoundCents(net)
+	expense.NetAmount = &net
+	expense.NetSplits = make([]models.ExpenseSplit, 0, len(expense.Splits))
+	for _, s := range expense.Splits {
+		key := splitKey{s.UserID, s.IsPaid}
+		amount, ok := remaining[key]
+		if !ok {
+			continue
+		}
+		delete(remaining, key)
+		expense.NetSplits = append(expense.NetSplits, models.ExpenseSplit{
+			UserID: s.UserID,
+			Amount: utils.RoundCents(amount),
+			IsPaid: s.IsPaid,
+		})
+	}
+	// Custom refunds may credit someone outside the original splits
+	for _, r := range expense.Refunds {
+		for _, s := range r.Splits {
+			key := splitKey{s.UserID, s.IsPaid}
+			if amount, ok := remaining[key]; ok {
+				delete(remaining, key)
+				expense.NetSplits = append(expense.NetSplits, models.ExpenseSplit{
+					UserID: s.UserID,
+					Amount: utils.RoundCents(amount),
+					IsPaid: s.IsPaid,
+				})
+			}
+		}
+	}
+}
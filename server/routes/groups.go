@@ -1,18 +1,25 @@
 package routes
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net/http"
+	"net/url"
 	"slices"
+	"time"
 
 	"shared-expenses-app/db"
+	"shared-expenses-app/mailer"
+	"shared-expenses-app/models"
+	"shared-expenses-app/policy"
 	"shared-expenses-app/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
+func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool, mail mailer.Mailer) {
 	// BUG: Remove it from production
 	//
 	// router.GET("list", func(c *gin.Context) {
@@ -41,12 +48,7 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 
 	// Create Group
 	router.POST("/", func(c *gin.Context) {
-		// Authenticate user
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
+		userID := requestUser(c)
 
 		var request struct {
 			Name        string `json:"name" binding:"required"`
@@ -78,12 +80,7 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 
 	// List groups the user is a member of
 	router.GET("/me", func(c *gin.Context) {
-		// Authenticate user
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
+		userID := requestUser(c)
 
 		groups, err := db.MemberOfGroups(c.Request.Context(), pool, userID)
 		if err != nil {
@@ -95,12 +92,7 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 
 	// List groups the user is admin of
 	router.GET("/admin", func(c *gin.Context) {
-		// Authenticate user
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
+		userID := requestUser(c)
 
 		groups, err := db.AdminOfGroups(c.Request.Context(), pool, userID)
 		if err != nil {
@@ -110,28 +102,43 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 		c.JSON(http.StatusOK, groups)
 	})
 
-	// Get group by ID
-	router.GET("/:id", func(c *gin.Context) {
-		// Authenticate user
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
+	// Join a group through an invite link
+	router.POST("/join/:token", func(c *gin.Context) {
+		userID := requestUser(c)
 
-		groupID := c.Param("id")
+		// Unverified accounts may be typos, keep them out if configured to
+		if utils.RestrictUnverifiedUsers() {
+			user, err := db.GetUser(c, pool, userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !user.Verified {
+				c.JSON(http.StatusForbidden, gin.H{"error": "verify your email before joining a group"})
+				return
+			}
+		}
 
-		// Check membership in that group
-		err = db.MemberOfGroup(c, pool, userID, groupID)
+		groupID, err := db.JoinGroupWithInvite(c.Request.Context(), pool, utils.HashToken(c.Param("token")), userID)
 		if err != nil {
-			if errors.Is(err, db.ErrNotMember) {
-				c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify membership"})
+			switch {
+			case errors.Is(err, db.ErrInvalidInvite):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case errors.Is(err, db.ErrAlreadyMember):
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error(), "group_id": groupID})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			}
 			return
 		}
 
+		c.JSON(http.StatusOK, gin.H{"message": "joined group", "group_id": groupID})
+	})
+
+	// Get group by ID
+	router.GET("/:id", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		groupID := c.Param("id")
+
 		// Retrieve group details
 		group, err := db.GetGroup(c, pool, groupID)
 		if err != nil {
@@ -143,40 +150,328 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 		c.JSON(http.StatusOK, group)
 	})
 
-	// Add members to a group
-	router.POST("/:id/members", func(c *gin.Context) {
+	// Net balance of every member, counting approved expenses only
+	router.GET("/:id/balances", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
 		groupID := c.Param("id")
 
-		type request struct {
-			UserIDs []string `json:"user_ids" binding:"required,min=1"`
+		balances, err := db.GroupBalances(c, pool, groupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
 		}
 
-		var req request
-		if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusOK, balances)
+	})
+
+	// Approved totals by kind, transfers and income are not counted as spending
+	router.GET("/:id/totals", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		groupID := c.Param("id")
+
+		totals, err := db.GroupTotals(c, pool, groupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, totals)
+	})
+
+	// Update group settings
+	router.PUT("/:id/settings", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		groupID := c.Param("id")
+
+		var request struct {
+			RequireConfirmation *bool `json:"require_confirmation" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		if err := db.SetRequireConfirmation(c, pool, groupID, *request.RequireConfirmation); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "settings updated"})
+	})
+
+	// Default member weights used by weights splits
+	router.GET("/:id/weights", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		groupID := c.Param("id")
+
+		weights, err := db.GroupWeights(c, pool, groupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, weights)
+	})
+
+	// Set default member weights, a weight of zero removes the member from weights splits
+	router.PUT("/:id/weights", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		groupID := c.Param("id")
+
+		var request struct {
+			Weights []models.MemberWeight `json:"weights" binding:"required,min=1"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		userIDs := make([]string, 0, len(request.Weights))
+		for _, w := range request.Weights {
+			if w.Weight < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "weights cannot be negative"})
+				return
+			}
+			userIDs = append(userIDs, w.UserID)
+		}
+		if err := db.AllMembersOfGroup(c, pool, userIDs, groupID, ""); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "user not in group"})
+			return
+		}
+
+		if err := db.SetGroupWeights(c, pool, groupID, request.Weights); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "weights updated"})
+	})
+
+	// List expense templates saved in a group
+	router.GET("/:id/templates", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		groupID := c.Param("id")
+
+		templates, err := db.GroupTemplates(c, pool, groupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, templates)
+	})
+
+	// Add a guest, a name-only member for friends who don't use the app
+	router.POST("/:id/guests", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		var request struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		name, err := utils.ValidateName(request.Name)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		guest, err := db.CreateGuest(c.Request.Context(), pool, c.Param("id"), name)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, guest)
+	})
+
+	// Create a link for the friend behind a guest to take it over, see /users/claim
+	router.POST("/:id/guests/:guest_id/claim", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		guestID := c.Param("guest_id")
+		if err := db.MemberOfGroup(c, pool, guestID, c.Param("id")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": db.ErrGuestNotFound.Error()})
+			return
+		}
+
+		expiry, err := utils.GuestClaimExpiry()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		token, tokenHash, err := utils.GenerateToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		expiresAt := time.Now().Add(expiry)
+
+		err = db.CreateGuestClaim(c.Request.Context(), pool, guestID, requestUser(c), tokenHash, expiresAt)
+		if err != nil {
+			if errors.Is(err, db.ErrGuestNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"claim_token": token,
+			"claim_url":   utils.Getenv("APP_URL", "http://localhost:8080") + "/claim?token=" + url.QueryEscape(token),
+			"expires_at":  expiresAt.Unix(),
+		})
+	})
+
+	// Create an invite link, returned only in this response
+	router.POST("/:id/invites", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		var request struct {
+			MaxUses   *int   `json:"max_uses" binding:"omitempty,min=1"` // omit for no limit
+			ExpiresAt *int64 `json:"expires_at"`                         // unix seconds, omit for no expiry
+		}
+		if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		if request.ExpiresAt != nil && *request.ExpiresAt <= time.Now().Unix() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expiry must be in the future"})
+			return
+		}
+
+		token, tokenHash, err := utils.GenerateToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create invite"})
+			return
+		}
+
+		invite := models.GroupInvite{
+			GroupID:   c.Param("id"),
+			CreatedBy: requestUser(c),
+			MaxUses:   request.MaxUses,
+			ExpiresAt: request.ExpiresAt,
+		}
+		inviteID, err := db.CreateGroupInvite(c.Request.Context(), pool, invite, tokenHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"invite_id":  inviteID,
+			"token":      token,
+			"invite_url": utils.Getenv("APP_URL", "http://localhost:8080") + "/join?token=" + url.QueryEscape(token),
+		})
+	})
+
+	// List the invite links that can still be used
+	router.GET("/:id/invites", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		invites, err := db.GroupInvites(c.Request.Context(), pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, invites)
+	})
+
+	// Revoke an invite link
+	router.DELETE("/:id/invites/:invite_id", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		err := db.RevokeGroupInvite(c.Request.Context(), pool, c.Param("id"), c.Param("invite_id"))
+		if err != nil {
+			if errors.Is(err, db.ErrInviteNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "invite revoked"})
+	})
+
+	// Invite someone by email, whether or not they have an account yet
+	router.POST("/:id/invites/email", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		var request struct {
+			Email           string `json:"email" binding:"required,email"`
+			PlaceholderName string `json:"placeholder_name"` // adds a guest to split with until they join
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 			return
 		}
 
-		// Authenticate the requester
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
+		email, err := utils.ValidateEmail(request.Email)
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		placeholderName := ""
+		if request.PlaceholderName != "" {
+			placeholderName, err = utils.ValidateName(request.PlaceholderName)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
 
-		// Ensure requester is the admin (creator) of the group
-		groupCreator, err := db.GetGroupCreator(c, pool, groupID)
+		// Registered users are added directly instead
+		if user, err := db.GetUserFromEmail(c, pool, email); err == nil {
+			c.JSON(http.StatusConflict, gin.H{"error": "user already registered, add them as a member", "user_id": user.UserID})
+			return
+		}
+
+		groupID := c.Param("id")
+		invite, err := db.CreateEmailInvite(c.Request.Context(), pool, groupID, email, requestUser(c), placeholderName)
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			if errors.Is(err, db.ErrAlreadyInvited) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
-		if groupCreator != userID {
-			c.JSON(http.StatusForbidden, gin.H{"error": "only group admin can add members"})
+
+		inviterID := requestUser(c)
+		inBackground("group invite email", func(ctx context.Context) error {
+			return sendGroupInvite(ctx, pool, mail, groupID, inviterID, email)
+		})
+
+		c.JSON(http.StatusOK, invite)
+	})
+
+	// List email invites nobody has accepted yet
+	router.GET("/:id/invites/email", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		invites, err := db.PendingEmailInvites(c.Request.Context(), pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, invites)
+	})
+
+	// Withdraw an email invite
+	router.DELETE("/:id/invites/email/:invite_id", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		err := db.CancelEmailInvite(c.Request.Context(), pool, c.Param("id"), c.Param("invite_id"))
+		if err != nil {
+			if errors.Is(err, db.ErrInviteNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "invite cancelled"})
+	})
+
+	// Add members to a group
+	router.POST("/:id/members", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		groupID := c.Param("id")
+
+		type request struct {
+			UserIDs []string `json:"user_ids" binding:"required,min=1"`
+		}
+
+		var req request
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 			return
 		}
 
 		// Filter valid users (existing in DB)
 		validUserIDs := make([]string, 0, len(req.UserIDs))
+		skippedUserIDs := []string{}
 		for _, uid := range req.UserIDs {
 			err := db.UserExists(c, pool, uid)
 			if err == nil {
@@ -184,6 +479,7 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 				validUserIDs = append(validUserIDs, uid)
 			} else if errors.Is(err, db.ErrUserNotFound) {
 				// User doesn't exist, skip
+				skippedUserIDs = append(skippedUserIDs, uid)
 				continue
 			} else {
 				// Database error
@@ -192,8 +488,32 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 			}
 		}
 
+		// Unverified accounts may be typos, keep them out if configured to
+		if utils.RestrictUnverifiedUsers() {
+			unverified, err := db.UnverifiedUsers(c, pool, validUserIDs)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			validUserIDs = slices.DeleteFunc(validUserIDs, func(uid string) bool {
+				return slices.Contains(unverified, uid)
+			})
+			skippedUserIDs = append(skippedUserIDs, unverified...)
+		}
+
+		// Guests of other groups would become claimable from this one
+		guests, err := db.ForeignGuests(c, pool, groupID, validUserIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		validUserIDs = slices.DeleteFunc(validUserIDs, func(uid string) bool {
+			return slices.Contains(guests, uid)
+		})
+		skippedUserIDs = append(skippedUserIDs, guests...)
+
 		if len(validUserIDs) == 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "no valid user IDs"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "no valid user IDs", "skipped_members": skippedUserIDs})
 			return
 		}
 
@@ -204,58 +524,270 @@ func RegisterGroupsRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 			return
 		}
 
+		// Unknown IDs are reported, people without an account are invited by email
 		c.JSON(http.StatusOK, gin.H{
-			"message":       "members added successfully",
-			"added_members": validUserIDs,
+			"message":         "members added successfully",
+			"added_members":   validUserIDs,
+			"skipped_members": skippedUserIDs,
 		})
 	})
 
-	// Remove members from a group
-	router.DELETE("/:id/members", func(c *gin.Context) {
-		groupID := c.Param("id")
+	// Change the role of a member. Admins manage members and viewers, the owner
+	// manages admins too.
+	router.PUT("/:id/members/:user_id/role", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		groupID, userID := c.Param("id"), c.Param("user_id")
 
-		type request struct {
-			UserIDs []string `json:"user_ids" binding:"required,min=1"`
+		var request struct {
+			Role string `json:"role" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
 		}
 
-		var req request
-		if err := c.ShouldBindJSON(&req); err != nil {
+		role, err := db.GroupRole(c, pool, groupID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if role == "" {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not a member of group"})
+			return
+		}
+
+		if err := policy.CheckRoleChange(requestSubject(c).Role, role, request.Role); err != nil {
+			if errors.Is(err, policy.ErrInvalidRole) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		if err := db.SetMemberRole(c, pool, groupID, requestUser(c), userID, request.Role); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "role updated", "user_id": userID, "role": request.Role})
+	})
+
+	// Offer the group to another member. Ownership only changes hands once they accept.
+	router.POST("/:id/transfer-ownership", authorize(pool, groupParam, policy.Owner), func(c *gin.Context) {
+		groupID, ownerID := c.Param("id"), requestUser(c)
+
+		var request struct {
+			UserID string `json:"user_id" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
 			return
 		}
+		if request.UserID == ownerID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "you already own this group"})
+			return
+		}
+
+		if err := db.OfferOwnership(c.Request.Context(), pool, groupID, ownerID, request.UserID); err != nil {
+			switch {
+			case errors.Is(err, db.ErrNotMember):
+				c.JSON(http.StatusNotFound, gin.H{"error": "user not a member of group"})
+			case errors.Is(err, db.ErrCannotOwnGroup):
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "ownership offered", "pending_owner": request.UserID})
+	})
 
-		// Authenticate the requester
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
+	// Withdraw a pending ownership offer
+	router.DELETE("/:id/transfer-ownership", authorize(pool, groupParam, policy.Owner), func(c *gin.Context) {
+		err := db.CancelOwnershipOffer(c.Request.Context(), pool, c.Param("id"), requestUser(c))
 		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			if errors.Is(err, db.ErrNoOwnershipOffer) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
+		c.JSON(http.StatusOK, gin.H{"message": "ownership offer cancelled"})
+	})
 
-		// Ensure requester is the admin (creator) of the group
-		groupCreator, err := db.GetGroupCreator(c, pool, groupID)
+	// Accept ownership offered to you. The previous owner stays on as an admin.
+	router.POST("/:id/transfer-ownership/accept", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		err := db.AcceptOwnership(c.Request.Context(), pool, c.Param("id"), requestUser(c))
 		if err != nil {
-			c.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			switch {
+			case errors.Is(err, db.ErrNoOwnershipOffer):
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			case errors.Is(err, db.ErrNotMember):
+				// Left the group after the membership check
+				c.JSON(http.StatusConflict, gin.H{"error": "no longer a member of the group"})
+			default:
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
-		if groupCreator != userID {
-			c.JSON(http.StatusForbidden, gin.H{"error": "only group admin can remove members"})
+		c.JSON(http.StatusOK, gin.H{"message": "you now own this group"})
+	})
+
+	// Turn down ownership offered to you
+	router.POST("/:id/transfer-ownership/decline", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		err := db.DeclineOwnership(c.Request.Context(), pool, c.Param("id"), requestUser(c))
+		if err != nil {
+			if errors.Is(err, db.ErrNoOwnershipOffer) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
 			return
 		}
-		if slices.Contains(req.UserIDs, groupCreator) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot remove group admin"})
+		c.JSON(http.StatusOK, gin.H{"message": "ownership offer declined"})
+	})
+
+	// Get the group's history of membership, role and ownership changes, newest first
+	router.GET("/:id/history", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		events, err := db.GroupHistory(c.Request.Context(), pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, events)
+	})
+
+	// Leave a group, for members and viewers. The owner has to transfer ownership
+	// first and admins have to be made members by the owner, members who aren't
+	// settled up have to confirm with force=true.
+	router.POST("/:id/leave", authorize(pool, groupParam, policy.Member), func(c *gin.Context) {
+		groupID, userID := c.Param("id"), requestUser(c)
+
+		switch requestSubject(c).Role {
+		case models.RoleOwner:
+			c.JSON(http.StatusConflict, gin.H{"error": "the owner can't leave, transfer ownership first"})
+			return
+		case models.RoleAdmin:
+			c.JSON(http.StatusConflict, gin.H{"error": "admins can't leave, ask the owner to make you a member first"})
 			return
 		}
 
+		balance, err := db.MemberBalance(c, pool, groupID, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if balance.Net != 0 && c.Query("force") != "true" {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":   "you have an unsettled balance in this group, settle it or leave with force=true",
+				"balance": balance,
+			})
+			return
+		}
+
+		if err := db.RemoveGroupMember(c, pool, groupID, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "left group", "balance": balance})
+	})
+
+	// Remove members from a group. They become former members, who keep their
+	// history and still count in balances but can't be added to new expenses.
+	// reassign_to takes over what they have outstanding: their balance, and their
+	// splits in expenses that aren't approved yet.
+	router.DELETE("/:id/members", authorize(pool, groupParam, policy.Admin), func(c *gin.Context) {
+		groupID := c.Param("id")
+
+		type request struct {
+			UserIDs    []string `json:"user_ids" binding:"required,min=1"`
+			ReassignTo string   `json:"reassign_to"`
+		}
+
+		var req request
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		// Admins remove those below them, the owner can't be removed
+		actorRole := requestSubject(c).Role
+		for _, uid := range req.UserIDs {
+			role, err := db.GroupRole(c, pool, groupID, uid)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if role != "" && !policy.CanManage(actorRole, role) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "cannot remove a " + role + " of the group", "user_id": uid})
+				return
+			}
+		}
+
+		if req.ReassignTo != "" {
+			if slices.Contains(req.UserIDs, req.ReassignTo) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "cannot reassign to a member being removed"})
+				return
+			}
+			if err := db.MemberOfGroup(c, pool, req.ReassignTo, groupID); err != nil {
+				if errors.Is(err, db.ErrNotMember) {
+					c.JSON(http.StatusBadRequest, gin.H{"error": "reassign_to is not a member of the group"})
+				} else {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				}
+				return
+			}
+		}
+
+		// What they are owed or owe as they go
+		balances := make([]models.Balance, 0, len(req.UserIDs))
+		for _, uid := range utils.GetUniqueUserIDs(req.UserIDs) {
+			balance, err := db.MemberBalance(c, pool, groupID, uid)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			balances = append(balances, balance)
+		}
+
 		// Remove members
-		err = db.RemoveGroupMembers(c, pool, groupID, req.UserIDs)
+		reassigned, err := db.RemoveGroupMembers(c, pool, groupID, requestUser(c), req.UserIDs, req.ReassignTo)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to remove members"})
 			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{
-			"message":         "members removed",
-			"removed_members": req.UserIDs,
+			"message":            "members removed",
+			"removed_members":    req.UserIDs,
+			"balances":           balances,
+			"reassigned_members": reassigned,
 		})
 	})
 }
+
+// sendGroupInvite emails an invite to join the group, through registering with that email.
+func sendGroupInvite(ctx context.Context, pool *pgxpool.Pool, mail mailer.Mailer, groupID, inviterID, email string) error {
+	group, err := db.GetGroup(ctx, pool, groupID)
+	if err != nil {
+		return err
+	}
+	inviter, err := db.GetUser(ctx, pool, inviterID)
+	if err != nil {
+		return err
+	}
+
+	link := utils.Getenv("APP_URL", "http://localhost:8080") + "/register?email=" + url.QueryEscape(email)
+	return mail.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: inviter.Name + " invited you to " + group.Name,
+		Body: "Hi,\n\n" +
+			inviter.Name + " invited you to share expenses in " + group.Name + ". " +
+			"Create an account with this email and verify it to join:\n\n" +
+			link + "\n\n" +
+			"If you don't know them, you can ignore this email.",
+	})
+}
@@ -0,0 +1,258 @@
+package routes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"shared-expenses-app/db"
+	"shared-expenses-app/models"
+	"shared-expenses-app/policy"
+	"shared-expenses-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Context keys set by authenticate
+const (
+	ctxUserID    = "user_id"
+	ctxAuthError = "auth_error"
+	ctxSubject   = "subject"
+)
+
+// errInvalidBody is returned by resolvers that can't read the request body.
+var errInvalidBody = errors.New("invalid request body")
+
+// authenticate identifies the user making the request from an access token or a
+// personal access token, for handlers to read with currentUser. Requests without
+// valid credentials are left to requireUser and authorize, on the routes that need a user.
+//
+// Access tokens of revoked sessions are rejected right away, so a lost device is
+// cut off instead of when its token expires. Personal access tokens are rejected
+// outside their scopes and group.
+func authenticate(pool *pgxpool.Pool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authHeader := c.GetHeader("Authorization")
+		if token, ok := strings.CutPrefix(authHeader, "Bearer "); ok && utils.IsPersonalToken(token) {
+			authenticatePersonalToken(c, pool, token)
+			return
+		}
+
+		userID, err := utils.ExtractUserID(authHeader)
+		if err != nil {
+			c.Set(ctxAuthError, err)
+			c.Next()
+			return
+		}
+
+		if sessionID, err := utils.ExtractSessionID(authHeader); err == nil && sessionID != "" {
+			active, err := db.TouchSession(c.Request.Context(), pool, sessionID, sessionClient(c, "", ""))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to verify session"})
+				return
+			}
+			if !active {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session revoked"})
+				return
+			}
+		}
+
+		c.Set(ctxUserID, userID)
+		c.Next()
+	}
+}
+
+func authenticatePersonalToken(c *gin.Context, pool *pgxpool.Pool, rawToken string) {
+	token, err := db.AuthenticatePersonalToken(c.Request.Context(), pool, utils.HashToken(rawToken))
+	if err != nil {
+		if errors.Is(err, db.ErrTokenNotFound) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		} else {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to verify token"})
+		}
+		return
+	}
+
+	scope, allowed := requiredScope(c)
+	if !allowed {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "personal access tokens cannot be used here"})
+		return
+	}
+	if !slices.Contains(token.Scopes, scope) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token lacks the " + scope + " scope"})
+		return
+	}
+
+	if token.GroupID != nil {
+		groupID, err := requestGroup(c, pool)
+		if err != nil || groupID != *token.GroupID {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "token is limited to another group"})
+			return
+		}
+	}
+
+	c.Set(ctxUserID, token.UserID)
+	c.Next()
+}
+
+// requiredScope returns the scope a personal access token needs for the request.
+// Account routes (/auth, and changes under /users) are never open to them, so a
+// leaked token can't take over the account.
+func requiredScope(c *gin.Context) (string, bool) {
+	area, _, _ := strings.Cut(strings.TrimPrefix(c.FullPath(), "/"), "/")
+	if area == "" || area == "auth" {
+		return "", false
+	}
+
+	if c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead {
+		return models.ScopeRead, true
+	}
+
+	switch area {
+	case "expenses", "templates":
+		return models.ScopeExpensesWrite, true
+	case "groups":
+		return models.ScopeGroupsWrite, true
+	default:
+		return "", false
+	}
+}
+
+// requestGroup returns the group a request is about, from the group, expense or
+// template in its path, or from the body when creating an expense or template.
+func requestGroup(c *gin.Context, pool *pgxpool.Pool) (string, error) {
+	path := c.FullPath()
+	switch {
+	case strings.HasPrefix(path, "/groups/:id"):
+		return c.Param("id"), nil
+	case strings.HasPrefix(path, "/expenses/:id"):
+		return db.ExpenseGroup(c.Request.Context(), pool, c.Param("id"))
+	case strings.HasPrefix(path, "/templates/:id"):
+		return db.TemplateGroup(c.Request.Context(), pool, c.Param("id"))
+	case path == "/expenses/" || path == "/templates/":
+		return bodyGroup(c)
+	default:
+		return "", errors.New("request is not about a single group")
+	}
+}
+
+// bodyGroup reads the group_id of a JSON body, leaving the body for the handler.
+func bodyGroup(c *gin.Context) (string, error) {
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", err
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	var request struct {
+		GroupID string `json:"group_id"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", err
+	}
+	return request.GroupID, nil
+}
+
+// requireUser rejects requests that authenticate could not identify a user for.
+func requireUser(c *gin.Context) {
+	if _, err := currentUser(c); err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.Next()
+}
+
+// resolver finds the group a request is about, and who added the resource in it.
+type resolver func(c *gin.Context, pool *pgxpool.Pool) (groupID, addedBy string, err error)
+
+// groupParam resolves the group in the path.
+func groupParam(c *gin.Context, pool *pgxpool.Pool) (string, string, error) {
+	return c.Param("id"), "", nil
+}
+
+// expenseParam resolves the expense in the path and whoever added it.
+func expenseParam(c *gin.Context, pool *pgxpool.Pool) (string, string, error) {
+	return db.ExpenseOwner(c.Request.Context(), pool, c.Param("id"))
+}
+
+// templateParam resolves the template in the path and whoever created it.
+func templateParam(c *gin.Context, pool *pgxpool.Pool) (string, string, error) {
+	return db.TemplateOwner(c.Request.Context(), pool, c.Param("id"))
+}
+
+// groupInBody resolves the group_id of a resource being created.
+func groupInBody(c *gin.Context, pool *pgxpool.Pool) (string, string, error) {
+	groupID, err := bodyGroup(c)
+	if err != nil || groupID == "" {
+		return "", "", errInvalidBody
+	}
+	return groupID, "", nil
+}
+
+// authorize lets the request through if rule allows the user on the group that
+// resolve finds, and leaves the subject for handlers to read with requestSubject.
+func authorize(pool *pgxpool.Pool, resolve resolver, rule policy.Rule) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		groupID, addedBy, err := resolve(c, pool)
+		if err != nil {
+			if errors.Is(err, errInvalidBody) {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		role, err := db.GroupRole(c.Request.Context(), pool, groupID, userID)
+		if err != nil {
+			if errors.Is(err, db.ErrGroupNotFound) {
+				c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "failed to verify membership"})
+			}
+			return
+		}
+
+		subject := policy.Subject{UserID: userID, GroupID: groupID, Role: role, AddedBy: addedBy}
+		if err := rule.Check(subject); err != nil {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(ctxSubject, subject)
+		c.Next()
+	}
+}
+
+// requestSubject returns the subject authorized by the authorize middleware.
+func requestSubject(c *gin.Context) policy.Subject {
+	subject, _ := c.Value(ctxSubject).(policy.Subject)
+	return subject
+}
+
+// requestUser returns the user of a request that passed requireUser.
+func requestUser(c *gin.Context) string {
+	return c.GetString(ctxUserID)
+}
+
+// currentUser returns the user authenticated by the authenticate middleware.
+func currentUser(c *gin.Context) (string, error) {
+	if userID := c.GetString(ctxUserID); userID != "" {
+		return userID, nil
+	}
+	if err, ok := c.Value(ctxAuthError).(error); ok {
+		return "", err
+	}
+	return "", errors.New("authorization header missing or malformed")
+}
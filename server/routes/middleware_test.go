@@ -0,0 +1,59 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"shared-expenses-app/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthenticateAccessToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(authenticate(nil))
+	router.GET("/me", requireUser, func(c *gin.Context) {
+		c.String(http.StatusOK, requestUser(c))
+	})
+
+	token, err := utils.GenerateJWT("u1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := utils.GenerateChallengeJWT("u1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+		body   string
+	}{
+		{"access token", "Bearer " + token, http.StatusOK, "u1"},
+		{"missing header", "", http.StatusUnauthorized, ""},
+		{"not a bearer token", token, http.StatusUnauthorized, ""},
+		{"tampered token", "Bearer " + token + "x", http.StatusUnauthorized, ""},
+		{"two-factor challenge", "Bearer " + challenge, http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/me", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d (%s)", w.Code, tt.status, w.Body)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"shared-expenses-app/db"
+	"shared-expenses-app/oidc"
+	"shared-expenses-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// oidcLoginExpiry is how long the user has to sign in at the provider
+const oidcLoginExpiry = 10 * time.Minute
+
+func registerOIDCRoutes(router *gin.RouterGroup, pool *pgxpool.Pool, providers oidc.Providers) {
+	// List the configured providers
+	router.GET("/oidc/providers", func(c *gin.Context) {
+		names := make([]string, 0, len(providers))
+		for name := range providers {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+
+		c.JSON(http.StatusOK, gin.H{"providers": names})
+	})
+
+	// Start a login: returns the provider URL to open in a browser
+	router.GET("/oidc/:provider/login", func(c *gin.Context) {
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown provider"})
+			return
+		}
+
+		state, err := oidc.NewVerifier()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+		nonce, err := oidc.NewVerifier()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+		verifier, err := oidc.NewVerifier()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start login"})
+			return
+		}
+
+		authURL, err := provider.AuthURL(c.Request.Context(), state, nonce, verifier)
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = db.CreateLoginState(c.Request.Context(), pool, utils.HashToken(state), db.OIDCLoginState{
+			Provider:     provider.Name,
+			Nonce:        nonce,
+			CodeVerifier: verifier,
+			DeviceName:   c.Query("device_name"),
+		}, time.Now().Add(oidcLoginExpiry))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+	})
+
+	// Finish a login with the code and state the provider redirected back with.
+	// Works as the redirect target itself (GET) or called by the app (POST).
+	callback := func(c *gin.Context) {
+		var request struct {
+			Code  string `json:"code" form:"code" binding:"required"`
+			State string `json:"state" form:"state" binding:"required"`
+		}
+		if c.Request.Method == http.MethodGet {
+			if providerErr := c.Query("error"); providerErr != "" {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "provider returned " + providerErr})
+				return
+			}
+			if err := c.ShouldBindQuery(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		} else if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		provider, ok := providers[c.Param("provider")]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown provider"})
+			return
+		}
+
+		state, err := db.TakeLoginState(c.Request.Context(), pool, utils.HashToken(request.State))
+		if err != nil || state.Provider != provider.Name {
+			c.JSON(http.StatusBadRequest, gin.H{"error": db.ErrInvalidLoginState.Error()})
+			return
+		}
+
+		rawToken, err := provider.Exchange(c.Request.Context(), request.Code, state.CodeVerifier)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		claims, err := provider.VerifyIDToken(c.Request.Context(), rawToken, state.Nonce)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, err := userForClaims(c, pool, provider.Name, claims)
+		if err != nil {
+			if errors.Is(err, errEmailNotVerified) {
+				c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		completeLogin(c, pool, userID, state.DeviceName)
+	}
+	router.GET("/oidc/:provider/callback", callback)
+	router.POST("/oidc/:provider/callback", callback)
+}
+
+var errEmailNotVerified = errors.New("provider did not verify the email, cannot link account")
+
+// userForClaims finds the user a provider identity belongs to. Unknown identities
+// are linked to the account with the same email, or get a new account without a
+// password. Either way the provider must have verified the email, otherwise
+// anyone could take over an account by claiming its address.
+func userForClaims(c *gin.Context, pool *pgxpool.Pool, provider string, claims oidc.Claims) (string, error) {
+	userID, err := db.UserForIdentity(c, pool, provider, claims.Subject)
+	if err == nil {
+		return userID, nil
+	}
+	if !errors.Is(err, db.ErrUserNotFound) {
+		return "", err
+	}
+
+	if !claims.EmailVerified || claims.Email == "" {
+		return "", errEmailNotVerified
+	}
+	email, err := utils.ValidateEmail(claims.Email)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := db.GetUserFromEmail(c, pool, email)
+	if err == nil {
+		return user.UserID, db.LinkIdentity(c, pool, user.UserID, provider, claims.Subject, email)
+	}
+	if !errors.Is(err, db.ErrEmailNotRegistered) {
+		return "", err
+	}
+
+	name := claims.Name
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	if validName, err := utils.ValidateName(name); err == nil {
+		name = validName
+	}
+
+	userID, err = db.CreateUserWithIdentity(c, pool, name, email, provider, claims.Subject)
+	if err != nil {
+		return "", err
+	}
+
+	// The provider verified the email, so groups that invited it can be joined
+	joinInvitedGroups(c.Request.Context(), pool, userID, email)
+	return userID, nil
+}
@@ -3,18 +3,31 @@ package routes
 import (
 	"net/http"
 
+	"shared-expenses-app/mailer"
+	"shared-expenses-app/oidc"
+	"shared-expenses-app/ratelimit"
+	"shared-expenses-app/utils"
+
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func RegisterRoutes(router *gin.Engine, pool *pgxpool.Pool) {
+func RegisterRoutes(router *gin.Engine, pool *pgxpool.Pool, mail mailer.Mailer, providers oidc.Providers, attempts ratelimit.Store) {
 	// Health check
 	router.GET("/health", func(c *gin.Context) {
 		c.String(http.StatusOK, "ok")
 	})
 
-	RegisterAuthRoutes(router.Group("/auth"), pool)
-	RegisterUsersRoutes(router.Group("/users"), pool)
-	RegisterGroupsRoutes(router.Group("/groups"), pool)
-	RegisterExpensesRoutes(router.Group("/expenses"), pool)
+	// Public keys for other services to verify access tokens
+	router.GET("/.well-known/jwks.json", func(c *gin.Context) {
+		c.JSON(http.StatusOK, utils.JWKS())
+	})
+
+	router.Use(authenticate(pool))
+
+	RegisterAuthRoutes(router.Group("/auth"), pool, mail, providers, attempts)
+	RegisterUsersRoutes(router.Group("/users", requireUser), pool, attempts)
+	RegisterGroupsRoutes(router.Group("/groups", requireUser), pool, mail)
+	RegisterExpensesRoutes(router.Group("/expenses", requireUser), pool)
+	RegisterTemplatesRoutes(router.Group("/templates", requireUser), pool)
 }
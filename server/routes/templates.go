@@ -0,0 +1,290 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"shared-expenses-app/db"
+	"shared-expenses-app/models"
+	"shared-expenses-app/policy"
+	"shared-expenses-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func RegisterTemplatesRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
+	// Save an expense template
+	router.POST("/", authorize(pool, groupInBody, policy.Contributor), func(c *gin.Context) {
+		userID := requestUser(c)
+
+		var template models.ExpenseTemplate
+		if err := c.ShouldBindJSON(&template); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+		template.CreatedBy = userID
+
+		if err := validateTemplate(c, pool, &template); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		templateID, err := db.CreateTemplate(c, pool, template)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"template_id": templateID})
+	})
+
+	// Get template by ID
+	router.GET("/:id", authorize(pool, templateParam, policy.Member), func(c *gin.Context) {
+		template, err := db.GetTemplate(c, pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, template)
+	})
+
+	// Update template
+	router.PUT("/:id", authorize(pool, templateParam, policy.AnyOf(policy.Adder, policy.Admin)), func(c *gin.Context) {
+		var payload models.ExpenseTemplate
+		if err := c.ShouldBindJSON(&payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		// Fetch existing template
+		template, err := db.GetTemplate(c, pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+			return
+		}
+
+		payload.TemplateID = template.TemplateID
+		payload.GroupID = template.GroupID
+		if err := validateTemplate(c, pool, &payload); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.UpdateTemplate(c, pool, payload); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "template updated"})
+	})
+
+	// Delete template
+	router.DELETE("/:id", authorize(pool, templateParam, policy.AnyOf(policy.Adder, policy.Admin)), func(c *gin.Context) {
+		template, err := db.GetTemplate(c, pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+			return
+		}
+
+		if err := db.DeleteTemplate(c, pool, template.TemplateID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "template deleted"})
+	})
+
+	// Create an expense from a template
+	router.POST("/:id/expenses", authorize(pool, templateParam, policy.Contributor), func(c *gin.Context) {
+		userID := requestUser(c)
+
+		// Every field is optional, the template provides the defaults
+		var request struct {
+			Title       string   `json:"title"`
+			Description string   `json:"description"`
+			Amount      *float64 `json:"amount"`
+			Latitude    float64  `json:"latitude"`
+			Longitude   float64  `json:"longitude"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		template, err := db.GetTemplate(c, pool, c.Param("id"))
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "template not found"})
+			return
+		}
+
+		amount := template.Amount
+		if request.Amount != nil {
+			amount = *request.Amount
+		}
+		if amount <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid amount"})
+			return
+		}
+
+		expense, err := expenseFromTemplate(template, amount)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		expense.AddedBy = userID
+		expense.Latitude = request.Latitude
+		expense.Longitude = request.Longitude
+		if request.Title != "" {
+			expense.Title = request.Title
+		}
+		if request.Description != "" {
+			expense.Description = request.Description
+		}
+
+		// Weights templates split with the group weights as they are today
+		if err := applyGroupWeights(c, pool, &expense); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Participants may have left the group since the template was saved
+		if err := validateSplits(c, pool, expense); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		expenseID, err := db.CreateExpense(c, pool, expense)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"expense_id": expenseID})
+	})
+}
+
+// validateTemplate defaults the split mode and checks that the participants are
+// group members. Exact templates must also balance against their default amount,
+// weights templates only need payers since the owers come from the group weights.
+func validateTemplate(ctx context.Context, pool *pgxpool.Pool, template *models.ExpenseTemplate) error {
+	if template.SplitMode == "" {
+		template.SplitMode = models.SplitModeExact
+	}
+	if template.Amount < 0 {
+		return errors.New("invalid amount")
+	}
+
+	switch template.SplitMode {
+	case models.SplitModeExact:
+		if template.Amount == 0 {
+			return errors.New("exact split templates need a default amount")
+		}
+		return validateSplits(ctx, pool, models.Expense{
+			Kind:    models.ExpenseKindSpend,
+			GroupID: template.GroupID,
+			Amount:  template.Amount,
+			Splits:  template.Splits,
+		})
+
+	case models.SplitModeEqual, models.SplitModeWeights:
+		var payers, owers int
+		userIDs := make([]string, 0, len(template.Splits))
+		for _, s := range template.Splits {
+			userIDs = append(userIDs, s.UserID)
+			if s.IsPaid {
+				payers++
+			} else {
+				owers++
+			}
+		}
+		if payers == 0 {
+			return errors.New("template needs at least one payer")
+		}
+		if owers == 0 && template.SplitMode == models.SplitModeEqual {
+			return errors.New("template needs at least one ower")
+		}
+		if err := db.AllMembersOfGroup(ctx, pool, userIDs, template.GroupID, ""); err != nil {
+			return errors.New("split user not in group")
+		}
+
+		// Owers of weights templates would be ignored, so don't store them
+		if template.SplitMode == models.SplitModeWeights {
+			payerSplits := make([]models.ExpenseSplit, 0, payers)
+			for _, s := range template.Splits {
+				if s.IsPaid {
+					payerSplits = append(payerSplits, s)
+				}
+			}
+			template.Splits = payerSplits
+		}
+		return nil
+
+	default:
+		return errors.New("invalid split mode")
+	}
+}
+
+// expenseFromTemplate builds a new expense of the given amount from a template.
+// Both the paid and the owed side are divided in proportion to the template's
+// split amounts, or evenly for equal split templates. Weights templates only get
+// their payers here, the owers are added by applyGroupWeights.
+func expenseFromTemplate(template models.ExpenseTemplate, amount float64) (models.Expense, error) {
+	expense := models.Expense{
+		GroupID:     template.GroupID,
+		Title:       template.Title,
+		Description: template.Description,
+		Category:    template.Category,
+		Amount:      amount,
+		Kind:        models.ExpenseKindSpend,
+		SplitMode:   models.SplitModeExact,
+	}
+
+	var paid, owed []models.ExpenseSplit
+	for _, s := range template.Splits {
+		if s.IsPaid {
+			paid = append(paid, s)
+		} else {
+			owed = append(owed, s)
+		}
+	}
+	if len(paid) == 0 {
+		return models.Expense{}, errors.New("template needs at least one payer")
+	}
+
+	sides := [][]models.ExpenseSplit{paid, owed}
+	if template.SplitMode == models.SplitModeWeights {
+		expense.SplitMode = models.SplitModeWeights
+		sides = sides[:1]
+	} else if len(owed) == 0 {
+		return models.Expense{}, errors.New("template needs at least one ower")
+	}
+
+	for _, side := range sides {
+		weights := make([]float64, len(side))
+		for i, s := range side {
+			if template.SplitMode != models.SplitModeExact {
+				weights[i] = 1
+			} else {
+				weights[i] = s.Amount
+			}
+		}
+
+		parts, err := utils.SplitByWeights(amount, weights)
+		if err != nil {
+			return models.Expense{}, err
+		}
+		for i, s := range side {
+			expense.Splits = append(expense.Splits, models.ExpenseSplit{
+				UserID: s.UserID,
+				Amount: parts[i],
+				IsPaid: s.IsPaid,
+			})
+		}
+	}
+
+	return expense, nil
+}
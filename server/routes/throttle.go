@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"shared-expenses-app/db"
+	"shared-expenses-app/ratelimit"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Login throttling policies. Many users can share an IP address behind NAT, so
+// IPs get more room than a single account.
+var (
+	accountLoginPolicy = ratelimit.Policy{
+		FreeFailures:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	ipLoginPolicy = ratelimit.Policy{
+		FreeFailures:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        5 * time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	}
+)
+
+// loginThrottle slows down password and two-factor code guessing, both per
+// account and per client IP, before any password hash is checked.
+type loginThrottle struct {
+	pool    *pgxpool.Pool
+	account *ratelimit.Limiter
+	ip      *ratelimit.Limiter
+}
+
+func newLoginThrottle(pool *pgxpool.Pool, store ratelimit.Store) *loginThrottle {
+	return &loginThrottle{
+		pool:    pool,
+		account: ratelimit.NewLimiter(store, accountLoginPolicy),
+		ip:      ratelimit.NewLimiter(store, ipLoginPolicy),
+	}
+}
+
+func (t *loginThrottle) keys(c *gin.Context, account string) map[*ratelimit.Limiter]string {
+	return map[*ratelimit.Limiter]string{
+		t.account: "account:" + account,
+		t.ip:      "ip:" + c.ClientIP(),
+	}
+}
+
+// allow reports whether the account may try to log in from this client. If not,
+// it responds with 429 and a Retry-After header.
+func (t *loginThrottle) allow(c *gin.Context, account string) bool {
+	var wait time.Duration
+	for limiter, key := range t.keys(c, account) {
+		w, err := limiter.Wait(c.Request.Context(), key)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check login attempts"})
+			return false
+		}
+		wait = max(wait, w)
+	}
+
+	if wait > 0 {
+		setRetryAfter(c, wait)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed attempts, try again later"})
+		return false
+	}
+	return true
+}
+
+// fail records a failed attempt. Lockouts are recorded, and Retry-After is set if
+// the next attempt has to wait.
+func (t *loginThrottle) fail(c *gin.Context, account string) {
+	var wait time.Duration
+	for limiter, key := range t.keys(c, account) {
+		result, err := limiter.Fail(c.Request.Context(), key)
+		if err != nil {
+			log.Println("failed to record login attempt:", err)
+			continue
+		}
+		if result.Locked {
+			if err := db.RecordLockout(c.Request.Context(), t.pool, key, c.ClientIP(), result.Attempts); err != nil {
+				log.Println("failed to record login lockout:", err)
+			}
+		}
+		wait = max(wait, result.Wait)
+	}
+
+	if wait > 0 {
+		setRetryAfter(c, wait)
+	}
+}
+
+// succeed clears the failures of the account. The IP keeps its count, so one
+// valid account can't be used to reset guessing at others.
+func (t *loginThrottle) succeed(c *gin.Context, account string) {
+	if err := t.account.Reset(c.Request.Context(), "account:"+account); err != nil {
+		log.Println("failed to reset login attempts:", err)
+	}
+}
+
+func setRetryAfter(c *gin.Context, wait time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+}
@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"shared-expenses-app/db"
+	"shared-expenses-app/models"
+	"shared-expenses-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var personalTokenScopes = []string{models.ScopeRead, models.ScopeExpensesWrite, models.ScopeGroupsWrite}
+
+// registerTokenRoutes manages personal access tokens. Being under /auth, these
+// routes only accept a signed-in session, never another personal token.
+func registerTokenRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
+	// Create a personal access token, returned only in this response
+	router.POST("/tokens", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		var request struct {
+			Name      string   `json:"name" binding:"required"`
+			Scopes    []string `json:"scopes" binding:"required,min=1"`
+			GroupID   *string  `json:"group_id"`
+			ExpiresAt *int64   `json:"expires_at"` // unix seconds, omit for no expiry
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		token := models.PersonalAccessToken{
+			UserID:    userID,
+			Name:      strings.TrimSpace(request.Name),
+			GroupID:   request.GroupID,
+			ExpiresAt: request.ExpiresAt,
+		}
+		if token.Name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "name is empty"})
+			return
+		}
+		for _, scope := range request.Scopes {
+			if !slices.Contains(personalTokenScopes, scope) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid scope: " + scope})
+				return
+			}
+			if !slices.Contains(token.Scopes, scope) {
+				token.Scopes = append(token.Scopes, scope)
+			}
+		}
+		if token.ExpiresAt != nil && *token.ExpiresAt <= time.Now().Unix() {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expiry must be in the future"})
+			return
+		}
+		if token.GroupID != nil {
+			if err := db.MemberOfGroup(c, pool, userID, *token.GroupID); err != nil {
+				c.JSON(http.StatusForbidden, gin.H{"error": "user not a member of group"})
+				return
+			}
+		}
+
+		rawToken, tokenHash, err := utils.GeneratePersonalToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+
+		tokenID, err := db.CreatePersonalToken(c, pool, token, tokenHash)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"token_id": tokenID,
+			"token":    rawToken,
+			"message":  "store this token now, it will not be shown again",
+		})
+	})
+
+	// List personal access tokens
+	router.GET("/tokens", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		tokens, err := db.PersonalTokens(c, pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, tokens)
+	})
+
+	// Revoke a personal access token
+	router.DELETE("/tokens/:id", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := db.RevokePersonalToken(c, pool, userID, c.Param("id")); err != nil {
+			if errors.Is(err, db.ErrTokenNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "token revoked"})
+	})
+}
@@ -0,0 +1,281 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"shared-expenses-app/db"
+	"shared-expenses-app/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+func registerTwoFactorRoutes(router *gin.RouterGroup, pool *pgxpool.Pool, throttle *loginThrottle) {
+	// Finish a login with a code from the authenticator app or a recovery code
+	router.POST("/login/2fa", func(c *gin.Context) {
+		var request struct {
+			ChallengeToken string `json:"challenge_token" binding:"required"`
+			Code           string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		userID, deviceName, err := utils.ExtractChallenge(request.ChallengeToken)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Codes are short, so guessing is throttled like passwords
+		account := "2fa:" + userID
+		if !throttle.allow(c, account) {
+			return
+		}
+
+		ok, err := checkSecondFactor(c.Request.Context(), pool, userID, request.Code)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			throttle.fail(c, account)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two-factor code"})
+			return
+		}
+		throttle.succeed(c, account)
+
+		tokens, err := issueTokens(c.Request.Context(), pool, sessionClient(c, userID, deviceName))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create token"})
+			return
+		}
+
+		tokens["message"] = "login successful"
+		c.JSON(http.StatusOK, tokens)
+	})
+
+	// Start enrolment: returns a new secret to add to an authenticator app
+	router.POST("/2fa/enroll", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := db.GetUser(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create secret"})
+			return
+		}
+
+		if err := db.StartTOTPEnrolment(c.Request.Context(), pool, userID, secret); err != nil {
+			if errors.Is(err, db.ErrTwoFactorEnabled) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		issuer := utils.Getenv("TOTP_ISSUER", "Shared Expenses")
+		c.JSON(http.StatusOK, gin.H{
+			"secret":      secret,
+			"otpauth_uri": utils.TOTPURI(issuer, user.EmailAddress(), secret),
+		})
+	})
+
+	// Confirm enrolment with a first code, turning two-factor on.
+	// Returns the recovery codes, which are only ever shown here.
+	router.POST("/2fa/confirm", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		var request struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		state, err := db.GetTOTP(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if state.Enabled {
+			c.JSON(http.StatusConflict, gin.H{"error": db.ErrTwoFactorEnabled.Error()})
+			return
+		}
+		if state.Secret == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": db.ErrNoTwoFactorSecret.Error()})
+			return
+		}
+
+		step, ok := utils.ValidateTOTP(state.Secret, request.Code, state.LastStep)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid two-factor code"})
+			return
+		}
+
+		codes, hashes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create recovery codes"})
+			return
+		}
+
+		if err := db.EnableTOTP(c.Request.Context(), pool, userID, step, hashes); err != nil {
+			if errors.Is(err, db.ErrTwoFactorEnabled) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":        "two-factor authentication enabled",
+			"recovery_codes": codes,
+		})
+	})
+
+	// Replace the recovery codes, invalidating the old ones
+	router.POST("/2fa/recovery-codes", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		var request struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		if !checkCurrentSecondFactor(c, pool, throttle, userID, request.Code) {
+			return
+		}
+
+		codes, hashes, err := utils.GenerateRecoveryCodes(recoveryCodeCount)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create recovery codes"})
+			return
+		}
+		if err := db.ReplaceRecoveryCodes(c.Request.Context(), pool, userID, hashes); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	})
+
+	// Turn two-factor off, which needs both the password (if the account has one) and a code
+	router.POST("/2fa/disable", func(c *gin.Context) {
+		userID, err := currentUser(c)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		var request struct {
+			Password string `json:"password"`
+			Code     string `json:"code" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := db.GetUser(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, savedPassword, err := db.GetUserCredentials(c.Request.Context(), pool, user.EmailAddress())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if savedPassword != "" {
+			if _, ok := checkCurrentPassword(c, pool, throttle, userID, request.Password); !ok {
+				return
+			}
+		}
+
+		if !checkCurrentSecondFactor(c, pool, throttle, userID, request.Code) {
+			return
+		}
+
+		if err := db.DisableTOTP(c.Request.Context(), pool, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+	})
+}
+
+// checkCurrentSecondFactor confirms a signed-in user's two-factor code before a
+// sensitive change, throttled like the login code. Responds and returns false if
+// it is wrong or two-factor authentication is off.
+func checkCurrentSecondFactor(c *gin.Context, pool *pgxpool.Pool, throttle *loginThrottle, userID, code string) bool {
+	account := "2fa:" + userID
+	if !throttle.allow(c, account) {
+		return false
+	}
+
+	ok, err := checkSecondFactor(c.Request.Context(), pool, userID, code)
+	if err != nil {
+		if errors.Is(err, db.ErrTwoFactorNotEnabled) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return false
+	}
+	if !ok {
+		throttle.fail(c, account)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid two-factor code"})
+		return false
+	}
+
+	throttle.succeed(c, account)
+	return true
+}
+
+// checkSecondFactor accepts either a current code from the user's authenticator
+// app or one of their unused recovery codes, spending it.
+func checkSecondFactor(ctx context.Context, pool *pgxpool.Pool, userID, code string) (bool, error) {
+	state, err := db.GetTOTP(ctx, pool, userID)
+	if err != nil {
+		return false, err
+	}
+	if !state.Enabled {
+		return false, db.ErrTwoFactorNotEnabled
+	}
+
+	if step, ok := utils.ValidateTOTP(state.Secret, code, state.LastStep); ok {
+		return db.UseTOTPStep(ctx, pool, userID, step)
+	}
+
+	return db.UseRecoveryCode(ctx, pool, userID, utils.HashRecoveryCode(code))
+}
@@ -1,29 +1,35 @@
 package routes
 
 import (
-	"context"
 	"errors"
+	"io"
 	"net/http"
+	"time"
 
 	"shared-expenses-app/db"
+	"shared-expenses-app/ratelimit"
 	"shared-expenses-app/utils"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func RegisterUsersRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
+func RegisterUsersRoutes(router *gin.RouterGroup, pool *pgxpool.Pool, attempts ratelimit.Store) {
+	throttle := newLoginThrottle(pool, attempts)
+
 	// User details
 	router.GET("/:id", func(c *gin.Context) {
 		qUserID := c.Param("id")
+		userID := requestUser(c)
 
-		userID, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		// Merged accounts point to the account they were merged into
+		if mergedInto, err := db.UserRedirect(c.Request.Context(), pool, qUserID); err == nil {
+			c.Header("Location", "/users/"+mergedInto)
+			c.JSON(http.StatusMovedPermanently, gin.H{"error": "user merged", "merged_into": mergedInto})
 			return
 		}
 
-		err = db.UsersRelated(context.Background(), pool, userID, qUserID)
+		err := db.UsersRelated(c.Request.Context(), pool, userID, qUserID)
 		if err != nil {
 			if errors.Is(err, db.ErrUsersNotRelated) {
 				c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
@@ -35,7 +41,7 @@ func RegisterUsersRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 
 		// At this point, users are related
 
-		result, err := db.GetUser(context.Background(), pool, qUserID)
+		result, err := db.GetUser(c.Request.Context(), pool, qUserID)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
@@ -46,13 +52,6 @@ func RegisterUsersRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 
 	// User details from email
 	router.GET("/search/email/:email", func(c *gin.Context) {
-		// Authenticate requester
-		_, err := utils.ExtractUserID(c.GetHeader("Authorization"))
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			return
-		}
-
 		email, err := utils.ValidateEmail(c.Param("email"))
 		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid email format"})
@@ -66,4 +65,177 @@ func RegisterUsersRoutes(router *gin.RouterGroup, pool *pgxpool.Pool) {
 
 		c.JSON(http.StatusOK, user)
 	})
+
+	// Take over a guest with a claim token, with all its memberships and splits
+	router.POST("/claim", func(c *gin.Context) {
+		var request struct {
+			Token string `json:"token" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "token required"})
+			return
+		}
+
+		userID := requestUser(c)
+
+		// The guest's groups would let an unverified account in otherwise
+		if utils.RestrictUnverifiedUsers() {
+			user, err := db.GetUser(c.Request.Context(), pool, userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			if !user.Verified {
+				c.JSON(http.StatusForbidden, gin.H{"error": "verify your email before claiming a guest"})
+				return
+			}
+		}
+
+		guestID, err := db.ClaimGuest(c.Request.Context(), pool, utils.HashToken(request.Token), userID)
+		if err != nil {
+			if errors.Is(err, db.ErrInvalidClaimToken) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "guest claimed", "guest_id": guestID})
+	})
+
+	// Merge a duplicate account into another, for server admins
+	router.POST("/merge", func(c *gin.Context) {
+		if !utils.IsAdmin(requestUser(c)) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "only admins can merge other accounts"})
+			return
+		}
+
+		var request struct {
+			FromUserID string `json:"from_user_id" binding:"required"`
+			IntoUserID string `json:"into_user_id" binding:"required"`
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		if err := db.MergeAccounts(c.Request.Context(), pool, request.FromUserID, request.IntoUserID); err != nil {
+			if errors.Is(err, db.ErrUserNotFound) {
+				c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "accounts merged", "merged_user_id": request.FromUserID})
+	})
+
+	// Delete the account. The user is anonymized rather than removed, so the
+	// groups they were in keep a balanced ledger. Unsettled balances block the
+	// deletion unless force is set, groups the user administers always do.
+	router.DELETE("/me", func(c *gin.Context) {
+		userID := requestUser(c)
+
+		var request struct {
+			Password string `json:"password"`
+			Code     string `json:"code"` // two-factor code, for accounts without a password
+		}
+		if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+			return
+		}
+
+		// Accounts confirm their password, or else a two-factor code or a fresh
+		// sign-in, so a stolen session can't delete them
+		user, err := db.GetUser(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		_, savedPassword, err := db.GetUserCredentials(c.Request.Context(), pool, user.EmailAddress())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if savedPassword != "" {
+			if _, ok := checkCurrentPassword(c, pool, throttle, userID, request.Password); !ok {
+				return
+			}
+		} else if !confirmPasswordless(c, pool, throttle, userID, request.Code) {
+			return
+		}
+
+		groups, err := db.SharedGroupsOwnedBy(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(groups) > 0 {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":  "user owns groups with other members, transfer them or remove the members first",
+				"groups": groups,
+			})
+			return
+		}
+
+		balances, err := db.UserBalances(c.Request.Context(), pool, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if len(balances) > 0 && c.Query("force") != "true" {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":    "user has unsettled balances, settle them or delete with force=true",
+				"balances": balances,
+			})
+			return
+		}
+
+		if err := db.DeleteUser(c.Request.Context(), pool, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":  "account deleted",
+			"balances": balances,
+		})
+	})
+}
+
+// recentSignIn is how fresh a sign-in has to be to stand in for a password
+const recentSignIn = 10 * time.Minute
+
+// confirmPasswordless confirms a sensitive change for an account without a
+// password: with a two-factor code if it has two-factor authentication, or else
+// by having signed in to this session recently. Responds and returns false if not.
+func confirmPasswordless(c *gin.Context, pool *pgxpool.Pool, throttle *loginThrottle, userID, code string) bool {
+	totp, err := db.GetTOTP(c.Request.Context(), pool, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if totp.Enabled {
+		if code == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "two-factor code required"})
+			return false
+		}
+		return checkCurrentSecondFactor(c, pool, throttle, userID, code)
+	}
+
+	var startedAt time.Time
+	if sessionID, _ := utils.ExtractSessionID(c.GetHeader("Authorization")); sessionID != "" {
+		startedAt, err = db.SessionStartedAt(c.Request.Context(), pool, userID, sessionID)
+		if err != nil && !errors.Is(err, db.ErrSessionNotFound) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return false
+		}
+	}
+	if time.Since(startedAt) > recentSignIn {
+		c.JSON(http.StatusForbidden, gin.H{"error": "sign in again to confirm this change"})
+		return false
+	}
+	return true
 }
@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -34,7 +36,11 @@ func HashPassword(password string) (string, error) {
 }
 
 // CheckPassword compares a plaintext password with its hashed version.
+// Accounts without a password never match.
 func CheckPassword(password, hashed string) bool {
+	if hashed == "" {
+		return false
+	}
 	err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
 	return err == nil
 }
@@ -51,34 +57,157 @@ func randB64() string {
 
 var jwtSecret = []byte(Getenv("JWT_SECRET", randB64()))
 
-func GenerateJWT(userID string) (string, error) {
-	expiryStr := Getenv("JWT_EXPIRY", "24")
-	expiryHours, err := strconv.Atoi(expiryStr)
-	if err != nil || expiryHours <= 0 {
-		return "", fmt.Errorf("invalid JWT_EXPIRY value: %q, must be a positive integer", expiryStr)
+var warnJWTExpiry sync.Once
+
+// AccessTokenExpiry returns how long access tokens are valid, from JWT_ACCESS_EXPIRY in minutes.
+// The deprecated JWT_EXPIRY, in hours, still applies if JWT_ACCESS_EXPIRY is unset.
+func AccessTokenExpiry() (time.Duration, error) {
+	if _, ok := os.LookupEnv("JWT_ACCESS_EXPIRY"); !ok {
+		if _, ok := os.LookupEnv("JWT_EXPIRY"); ok {
+			warnJWTExpiry.Do(func() {
+				log.Println("[WARN] JWT_EXPIRY is deprecated, set JWT_ACCESS_EXPIRY in minutes and JWT_REFRESH_EXPIRY in hours instead")
+			})
+			return envDuration("JWT_EXPIRY", "24", time.Hour)
+		}
+	}
+	return envDuration("JWT_ACCESS_EXPIRY", "15", time.Minute)
+}
+
+// RefreshTokenExpiry returns how long refresh tokens are valid, from JWT_REFRESH_EXPIRY in hours.
+func RefreshTokenExpiry() (time.Duration, error) {
+	return envDuration("JWT_REFRESH_EXPIRY", "720", time.Hour)
+}
+
+// PasswordResetExpiry returns how long password reset links are valid, from PASSWORD_RESET_EXPIRY in minutes.
+func PasswordResetExpiry() (time.Duration, error) {
+	return envDuration("PASSWORD_RESET_EXPIRY", "60", time.Minute)
+}
+
+// EmailVerificationExpiry returns how long email verification links are valid, from EMAIL_VERIFICATION_EXPIRY in hours.
+func EmailVerificationExpiry() (time.Duration, error) {
+	return envDuration("EMAIL_VERIFICATION_EXPIRY", "48", time.Hour)
+}
+
+// GuestClaimExpiry returns how long guest claim links are valid, from GUEST_CLAIM_EXPIRY in hours.
+func GuestClaimExpiry() (time.Duration, error) {
+	return envDuration("GUEST_CLAIM_EXPIRY", "168", time.Hour)
+}
+
+// IsAdmin reports whether the user is a server admin, listed in the comma
+// separated ADMIN_USER_IDS. There are none by default.
+func IsAdmin(userID string) bool {
+	for _, id := range strings.Split(Getenv("ADMIN_USER_IDS", ""), ",") {
+		if id = strings.TrimSpace(id); id != "" && id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustedProxies returns the proxies, as IPs or CIDRs, whose X-Forwarded-For
+// header is believed, from the comma separated TRUSTED_PROXIES. There are none by
+// default, so the client IP is the address the request came from.
+func TrustedProxies() []string {
+	var proxies []string
+	for _, proxy := range strings.Split(Getenv("TRUSTED_PROXIES", ""), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	return proxies
+}
+
+// RestrictUnverifiedUsers reports whether users who haven't verified their email
+// are kept out of groups and splits, from RESTRICT_UNVERIFIED_USERS.
+func RestrictUnverifiedUsers() bool {
+	return GetenvBool("RESTRICT_UNVERIFIED_USERS", false)
+}
+
+func envDuration(key, defaultVal string, unit time.Duration) (time.Duration, error) {
+	valStr := Getenv(key, defaultVal)
+	val, err := strconv.Atoi(valStr)
+	if err != nil || val <= 0 {
+		return 0, fmt.Errorf("invalid %s value: %q, must be a positive integer", key, valStr)
+	}
+	return time.Duration(val) * unit, nil
+}
+
+// GenerateJWT issues a short-lived access token for a user's session (token family).
+func GenerateJWT(userID, sessionID string) (string, error) {
+	expiry, err := AccessTokenExpiry()
+	if err != nil {
+		return "", err
 	}
 	claims := jwt.MapClaims{
+		"typ":     tokenTypeAccess,
 		"user_id": userID,
-		"exp":     time.Now().Add(time.Duration(expiryHours) * time.Hour).Unix(),
+		"sid":     sessionID,
+		"exp":     time.Now().Add(expiry).Unix(),
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return signJWT(claims)
 }
 
+// Token types, so that a token issued for one purpose can't be used for another
+const (
+	tokenTypeAccess    = "access"
+	tokenTypeChallenge = "2fa"
+)
+
+// challengeExpiry is how long the second login step may take
+const challengeExpiry = 5 * time.Minute
+
+// GenerateChallengeJWT issues the token that proves a user passed the password step
+// of a login, to be exchanged for a session once the second factor is checked.
+func GenerateChallengeJWT(userID, deviceName string) (string, error) {
+	claims := jwt.MapClaims{
+		"typ":     tokenTypeChallenge,
+		"user_id": userID,
+		"device":  deviceName,
+		"exp":     time.Now().Add(challengeExpiry).Unix(),
+	}
+
+	return signJWT(claims)
+}
+
+// ExtractChallenge returns the user and device name of a login challenge token.
+func ExtractChallenge(tokenString string) (string, string, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return "", "", err
+	}
+	if claims["typ"] != tokenTypeChallenge {
+		return "", "", errors.New("invalid token type")
+	}
+
+	userID, ok := claims["user_id"].(string)
+	if !ok {
+		return "", "", errors.New("invalid token claims")
+	}
+	deviceName, _ := claims["device"].(string)
+
+	return userID, deviceName, nil
+}
+
+// ExtractClaims returns the claims of the access token in an Authorization header.
 func ExtractClaims(authHeader string) (jwt.MapClaims, error) {
 	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
 		return nil, errors.New("authorization header missing or malformed")
 	}
 
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	claims, err := parseJWT(strings.TrimPrefix(authHeader, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+	if claims["typ"] != tokenTypeAccess {
+		return nil, errors.New("invalid token type")
+	}
+
+	return claims, nil
+}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
-		}
-		return []byte(jwtSecret), nil
-	})
+func parseJWT(tokenString string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, verificationKey)
 	if err != nil {
 		return nil, errors.New("invalid token")
 	}
@@ -106,3 +235,18 @@ func ExtractUserID(authHeader string) (string, error) {
 
 	return userID, nil
 }
+
+// ExtractSessionID returns the session (token family) an access token belongs to.
+func ExtractSessionID(authHeader string) (string, error) {
+	claims, err := ExtractClaims(authHeader)
+	if err != nil {
+		return "", err
+	}
+
+	sessionID, ok := claims["sid"].(string)
+	if !ok {
+		return "", errors.New("invalid token claims")
+	}
+
+	return sessionID, nil
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"os"
+	"strconv"
 
 	"github.com/joho/godotenv"
 )
@@ -21,3 +22,12 @@ func Getenv(key, defaultVal string) string {
 
 	return val
 }
+
+// GetenvBool reads a boolean setting, falling back to defaultVal if it is unset or invalid.
+func GetenvBool(key string, defaultVal bool) bool {
+	val, err := strconv.ParseBool(Getenv(key, strconv.FormatBool(defaultVal)))
+	if err != nil {
+		return defaultVal
+	}
+	return val
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWT signing keys.
+//
+// With JWT_PRIVATE_KEY_FILE set, tokens are signed with that Ed25519 or RSA key
+// (PEM, PKCS#8 or PKCS#1) and carry its key ID in the kid header. To rotate, move
+// the old key file to JWT_PREVIOUS_KEY_FILES (comma separated, private or public
+// keys) and point JWT_PRIVATE_KEY_FILE at the new one. Tokens signed with the old
+// key keep working until they expire, then it can be dropped.
+//
+// Without a key file, tokens are signed with HS256 and JWT_SECRET. HS256 tokens
+// are also accepted next to a key file as long as JWT_SECRET is set, which covers
+// moving from a secret to a key pair.
+
+type signingKey struct {
+	kid     string
+	method  jwt.SigningMethod
+	private crypto.Signer // nil for keys only kept to verify
+	public  crypto.PublicKey
+}
+
+var (
+	currentKey *signingKey
+	verifyKeys = map[string]*signingKey{}
+	allowHMAC  = true
+)
+
+// LoadSigningKeys reads the key files configured in JWT_PRIVATE_KEY_FILE and
+// JWT_PREVIOUS_KEY_FILES. Without them, tokens are signed with HS256.
+func LoadSigningKeys() error {
+	path := Getenv("JWT_PRIVATE_KEY_FILE", "")
+	if path == "" {
+		if _, ok := os.LookupEnv("JWT_SECRET"); !ok {
+			log.Println("[WARN] Neither JWT_PRIVATE_KEY_FILE nor JWT_SECRET is set, tokens will not survive a restart")
+		}
+		return nil
+	}
+
+	key, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	if key.private == nil {
+		return fmt.Errorf("%s: JWT_PRIVATE_KEY_FILE must hold a private key", path)
+	}
+
+	keys := map[string]*signingKey{key.kid: key}
+	for previous := range strings.SplitSeq(Getenv("JWT_PREVIOUS_KEY_FILES", ""), ",") {
+		previous = strings.TrimSpace(previous)
+		if previous == "" {
+			continue
+		}
+		k, err := readKeyFile(previous)
+		if err != nil {
+			return err
+		}
+		keys[k.kid] = k
+	}
+
+	currentKey = key
+	verifyKeys = keys
+	_, allowHMAC = os.LookupEnv("JWT_SECRET")
+	return nil
+}
+
+func readKeyFile(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key := &signingKey{}
+	switch k := parsed.(type) {
+	case ed25519.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodEdDSA, k, k.Public()
+	case ed25519.PublicKey:
+		key.method, key.public = jwt.SigningMethodEdDSA, k
+	case *rsa.PrivateKey:
+		key.method, key.private, key.public = jwt.SigningMethodRS256, k, k.Public()
+	case *rsa.PublicKey:
+		key.method, key.public = jwt.SigningMethodRS256, k
+	default:
+		return nil, fmt.Errorf("%s: only Ed25519 and RSA keys are supported", path)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	key.kid = base64.RawURLEncoding.EncodeToString(sum[:12])
+
+	return key, nil
+}
+
+// signJWT signs claims with the current key, or HS256 if no key file is configured.
+func signJWT(claims jwt.MapClaims) (string, error) {
+	if currentKey == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	}
+
+	token := jwt.NewWithClaims(currentKey.method, claims)
+	token.Header["kid"] = currentKey.kid
+	return token.SignedString(currentKey.private)
+}
+
+// verificationKey picks the key to check a token with, from its kid header.
+func verificationKey(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if currentKey != nil && !allowHMAC {
+			return nil, errors.New("unexpected signing method")
+		}
+		return jwtSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := verifyKeys[kid]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, errors.New("unexpected signing method")
+	}
+	return key.public, nil
+}
+
+// JWKS returns the public signing keys as a JSON Web Key Set, so other services
+// can verify access tokens. It is empty when tokens are signed with HS256.
+func JWKS() map[string]any {
+	keys := []map[string]string{}
+	for _, key := range verifyKeys {
+		jwk := map[string]string{
+			"kid": key.kid,
+			"alg": key.method.Alg(),
+			"use": "sig",
+		}
+		switch k := key.public.(type) {
+		case ed25519.PublicKey:
+			jwk["kty"] = "OKP"
+			jwk["crv"] = "Ed25519"
+			jwk["x"] = base64.RawURLEncoding.EncodeToString(k)
+		case *rsa.PublicKey:
+			jwk["kty"] = "RSA"
+			jwk["n"] = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+			jwk["e"] = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+		}
+		keys = append(keys, jwk)
+	}
+	slices.SortFunc(keys, func(a, b map[string]string) int { return strings.Compare(a["kid"], b["kid"]) })
+	return map[string]any{"keys": keys}
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// RoundCents rounds an amount to two decimal places.
+func RoundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
+
+// SplitByWeights divides amount proportionally to weights, in whole cents. Each
+// part is its exact share rounded down, and the cents left over go to the parts
+// that were rounded down the most, so the parts always add up to amount and each
+// is within a cent of its exact share.
+func SplitByWeights(amount float64, weights []float64) ([]float64, error) {
+	var total float64
+	for _, w := range weights {
+		if w < 0 {
+			return nil, errors.New("weights cannot be negative")
+		}
+		total += w
+	}
+	if total == 0 {
+		return nil, errors.New("weights must add up to more than zero")
+	}
+
+	cents := int64(math.Round(amount * 100))
+	partCents := make([]int64, len(weights))
+	remainders := make([]float64, len(weights))
+	left := cents
+	for i, w := range weights {
+		exact := float64(cents) * w / total
+		partCents[i] = int64(math.Floor(exact))
+		remainders[i] = exact - float64(partCents[i])
+		left -= partCents[i]
+	}
+
+	// Largest remainders first, earlier parts first on ties
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for i := 0; left > 0; i++ {
+		partCents[order[i%len(order)]]++
+		left--
+	}
+
+	parts := make([]float64, len(weights))
+	for i, c := range partCents {
+		parts[i] = float64(c) / 100
+	}
+	return parts, nil
+}
+
+// SplitEqually divides amount into n parts that differ by at most one cent.
+func SplitEqually(amount float64, n int) ([]float64, error) {
+	if n <= 0 {
+		return nil, errors.New("nothing to split between")
+	}
+
+	weights := make([]float64, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	return SplitByWeights(amount, weights)
+}
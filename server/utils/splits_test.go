@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestSplitEqually(t *testing.T) {
+	tests := []struct {
+		amount float64
+		n      int
+		want   []float64
+	}{
+		{10, 3, []float64{3.34, 3.33, 3.33}},
+		{0.05, 10, []float64{0.01, 0.01, 0.01, 0.01, 0.01, 0, 0, 0, 0, 0}},
+		{0.02, 3, []float64{0.01, 0.01, 0}},
+		{100, 4, []float64{25, 25, 25, 25}},
+		{0, 2, []float64{0, 0}},
+	}
+	for _, tt := range tests {
+		got, err := SplitEqually(tt.amount, tt.n)
+		if err != nil {
+			t.Fatalf("SplitEqually(%v, %d): %v", tt.amount, tt.n, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SplitEqually(%v, %d) = %v, want %v", tt.amount, tt.n, got, tt.want)
+		}
+	}
+
+	if _, err := SplitEqually(10, 0); err == nil {
+		t.Error("SplitEqually(10, 0) succeeded, want an error")
+	}
+}
+
+func TestSplitByWeights(t *testing.T) {
+	tests := []struct {
+		amount  float64
+		weights []float64
+		want    []float64
+	}{
+		{100, []float64{1, 1, 2}, []float64{25, 25, 50}},
+		{10, []float64{1, 0, 2}, []float64{3.33, 0, 6.67}},
+		{0.01, []float64{1, 1, 1}, []float64{0.01, 0, 0}},
+		{0.1, []float64{0, 3}, []float64{0, 0.1}},
+		{19.99, []float64{0.5, 0.25, 0.25}, []float64{9.99, 5, 5}},
+	}
+	for _, tt := range tests {
+		got, err := SplitByWeights(tt.amount, tt.weights)
+		if err != nil {
+			t.Fatalf("SplitByWeights(%v, %v): %v", tt.amount, tt.weights, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("SplitByWeights(%v, %v) = %v, want %v", tt.amount, tt.weights, got, tt.want)
+		}
+	}
+
+	for _, weights := range [][]float64{{}, {0, 0}, {1, -1}} {
+		if _, err := SplitByWeights(10, weights); err == nil {
+			t.Errorf("SplitByWeights(10, %v) succeeded, want an error", weights)
+		}
+	}
+}
+
+// Parts always add up to the amount, and are never negative or more than a cent
+// off their exact share.
+func TestSplitByWeightsInvariants(t *testing.T) {
+	weightSets := [][]float64{{1}, {1, 1, 1}, {1, 2, 3, 4}, {0.3, 0.3, 0.4}, {7, 0, 1, 1, 1, 1, 1, 1, 1, 1, 1}}
+	for _, weights := range weightSets {
+		var total float64
+		for _, w := range weights {
+			total += w
+		}
+		for cents := 0; cents <= 1000; cents += 7 {
+			amount := float64(cents) / 100
+			parts, err := SplitByWeights(amount, weights)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var sum float64
+			for i, p := range parts {
+				if p < 0 {
+					t.Fatalf("SplitByWeights(%v, %v) = %v, has a negative part", amount, weights, parts)
+				}
+				if math.Abs(p-amount*weights[i]/total) >= 0.01+1e-9 {
+					t.Fatalf("SplitByWeights(%v, %v) = %v, part %d is a cent or more off", amount, weights, parts, i)
+				}
+				sum += p
+			}
+			if RoundCents(sum) != amount {
+				t.Fatalf("SplitByWeights(%v, %v) = %v, adds up to %v", amount, weights, parts, sum)
+			}
+		}
+	}
+}
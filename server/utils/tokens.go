@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// GenerateToken returns a random URL-safe opaque token and the hash to store for it.
+func GenerateToken() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	return token, HashToken(token), nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash of an opaque token.
+// Tokens are random, so a fast unsalted hash is enough to keep them out of the database.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// PersonalTokenPrefix marks personal access tokens, so they can be told apart
+// from access tokens and spotted by secret scanners.
+const PersonalTokenPrefix = "sxp_"
+
+// GeneratePersonalToken returns a new personal access token and the hash to store for it.
+func GeneratePersonalToken() (string, string, error) {
+	token, _, err := GenerateToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	token = PersonalTokenPrefix + token
+	return token, HashToken(token), nil
+}
+
+// IsPersonalToken reports whether a bearer token is a personal access token.
+func IsPersonalToken(token string) bool {
+	return strings.HasPrefix(token, PersonalTokenPrefix)
+}